@@ -1,13 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/fatih/color"
 	"github.com/hashicorp/go-version"
@@ -21,9 +27,100 @@ const (
 	flagNameDebug   = "debug"
 	flagSkipUpgrade = "skip-upgrade"
 	flagUpdateDB    = "update-db"
+	flagDBBranch    = "db-branch"
+	flagCategory    = "category"
+	flagDBSummary   = "db-summary"
+	flagPrefix      = "prefix"
+	flagRizin       = "rizin"
+	flagPerRizin    = "per-rizin-site"
+	flagWait        = "wait"
 )
 
-var initSite = pkg.InitSite
+var initSite = pkg.InitSiteWithOptions
+
+func siteOptions(c *cli.Context, mode pkg.LockMode) pkg.SiteOptions {
+	return pkg.SiteOptions{
+		LockMode:     mode,
+		UpdateDB:     c.Bool(flagUpdateDB),
+		Prefix:       c.String(flagPrefix),
+		Rizin:        c.String(flagRizin),
+		PerRizinSite: c.Bool(flagPerRizin),
+		Wait:         c.Bool(flagWait),
+	}
+}
+
+// openSite initializes the site for a command, printing the database changes
+// when they have just been pulled and the user asked for them. Commands that
+// only read the site use pkg.LockShared, so that they can run concurrently.
+func openSite(c *cli.Context, mode pkg.LockMode) (pkg.ManagedSite, error) {
+	site, err := initSite(pkg.SiteDir(), siteOptions(c, mode))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Bool(flagDBSummary) {
+		changes, err := site.DatabaseChanges()
+		if err != nil {
+			log.Printf("Could not compute the database changes: %v\n", err)
+		} else if changes.Updated {
+			// kept apart from the output of the command
+			printDatabaseChanges(os.Stderr, site, changes)
+		}
+	}
+	return site, nil
+}
+
+// printDatabaseChanges prints changes to w, marking the installed packages
+func printDatabaseChanges(w io.Writer, site pkg.Site, changes pkg.DatabaseChanges) {
+	green := color.New(color.Bold, color.FgGreen).SprintFunc()
+	if len(changes.Added)+len(changes.Removed)+len(changes.Bumped) == 0 {
+		fmt.Fprintln(w, "No package changed with the last database update.")
+		return
+	}
+
+	installedInfo := func(name string) string {
+		if _, err := site.GetInstalledPackage(name); err == nil {
+			return green(" [installed]")
+		}
+		return ""
+	}
+	fmt.Fprintf(w, "Database changes (%.7s..%.7s):\n", changes.From, changes.To)
+	for _, p := range changes.Added {
+		fmt.Fprintf(w, "  added:   %s %s%s\n", p.Name, p.NewVersion, installedInfo(p.Name))
+	}
+	for _, p := range changes.Bumped {
+		fmt.Fprintf(w, "  updated: %s %s -> %s%s\n", p.Name, p.OldVersion, p.NewVersion, installedInfo(p.Name))
+	}
+	for _, p := range changes.Removed {
+		fmt.Fprintf(w, "  removed: %s %s%s\n", p.Name, p.OldVersion, installedInfo(p.Name))
+	}
+}
+
+func databaseChanges(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "changes")
+		return fmt.Errorf("wrong usage of db changes command")
+	}
+
+	site, err := initSite(pkg.SiteDir(), siteOptions(c, pkg.LockShared))
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	changes, err := site.DatabaseChanges()
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+	printDatabaseChanges(os.Stdout, site, changes)
+	return nil
+}
 
 func setDebug(value bool) {
 	if value {
@@ -39,7 +136,7 @@ func listPackages(c *cli.Context, installed bool) error {
 		return fmt.Errorf("wrong usage of list command")
 	}
 
-	site, err := initSite(pkg.SiteDir(), c.Bool(flagUpdateDB))
+	site, err := openSite(c, pkg.LockShared)
 	if err != nil {
 		return err
 	}
@@ -57,7 +154,13 @@ func listPackages(c *cli.Context, installed bool) error {
 
 	green := color.New(color.Bold, color.FgGreen).SprintFunc()
 	red := color.New(color.Bold, color.FgRed).SprintFunc()
+	yellow := color.New(color.Bold, color.FgYellow).SprintFunc()
+	categories := c.StringSlice(flagCategory)
 	for _, myPkg := range packages {
+		if !inCategories(myPkg, categories) {
+			continue
+		}
+
 		info := ""
 		if site.IsPackageInstalled(myPkg) {
 			info = green(" [installed]")
@@ -67,12 +170,33 @@ func listPackages(c *cli.Context, installed bool) error {
 					info += red(fmt.Sprintf(" [for rizin v%s]", *installedPackage.RizinVersion))
 				}
 			}
+			if err == nil && installedPackage.Broken {
+				info += red(" [broken]")
+			}
+			if err == nil && installedPackage.Disabled {
+				info += yellow(" [disabled]")
+			}
 		}
 		fmt.Printf("%s: %s%s\n", myPkg.Name(), myPkg.Summary(), info)
 	}
 	return nil
 }
 
+// inCategories reports whether p belongs to one of the given categories or to
+// one of their sub-categories. An empty list matches every package.
+func inCategories(p pkg.Package, categories []string) bool {
+	if len(categories) == 0 {
+		return true
+	}
+	for _, category := range categories {
+		category = strings.Trim(category, "/")
+		if p.Category() == category || strings.HasPrefix(p.Category(), category+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 func listAvailablePackages(c *cli.Context) error {
 	return listPackages(c, false)
 }
@@ -88,7 +212,7 @@ func infoPackage(c *cli.Context) error {
 		return fmt.Errorf("wrong usage of info command")
 	}
 
-	site, err := initSite(pkg.SiteDir(), c.Bool(flagUpdateDB))
+	site, err := openSite(c, pkg.LockShared)
 	if err != nil {
 		return err
 	}
@@ -115,133 +239,1121 @@ func infoPackage(c *cli.Context) error {
 	fmt.Printf("Version: %s\n", pkg.Version())
 	fmt.Printf("Summary: %s\n", pkg.Summary())
 	fmt.Printf("Description: %s\n", pkg.Description())
+	if pkg.Category() != "" {
+		fmt.Printf("Category: %s\n", pkg.Category())
+	}
 	fmt.Printf("Installed: %s\n", isInstalled)
 	return nil
 }
 
+// highlight colors the parts of text covered by the matches of field
+func highlight(text string, field string, matches []pkg.SearchMatch, colorize func(a ...interface{}) string) string {
+	ranges := []pkg.SearchMatch{}
+	for _, m := range matches {
+		if m.Field == field && m.Start < m.End && m.End <= len(text) {
+			ranges = append(ranges, m)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	var sb strings.Builder
+	pos := 0
+	for _, r := range ranges {
+		if r.End <= pos {
+			continue
+		}
+		start := max(r.Start, pos)
+		sb.WriteString(text[pos:start])
+		sb.WriteString(colorize(text[start:r.End]))
+		pos = r.End
+	}
+	sb.WriteString(text[pos:])
+	return sb.String()
+}
+
+type searchResultJSON struct {
+	Name        string            `json:"name"`
+	Version     string            `json:"version"`
+	Category    string            `json:"category,omitempty"`
+	Summary     string            `json:"summary"`
+	Description string            `json:"description,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Installed   bool              `json:"installed"`
+	Score       int               `json:"score"`
+	Matches     []pkg.SearchMatch `json:"matches"`
+}
+
+func searchPackages(c *cli.Context) error {
+	if c.Args().Len() < 1 {
+		cli.ShowCommandHelp(c, "search")
+		return fmt.Errorf("wrong usage of search command")
+	}
+
+	filter := pkg.SearchAll
+	filters := 0
+	if c.Bool("installed") {
+		filter = pkg.SearchInstalled
+		filters++
+	}
+	if c.Bool("not-installed") {
+		filter = pkg.SearchNotInstalled
+		filters++
+	}
+	if c.Bool("upgradable") {
+		filter = pkg.SearchUpgradable
+		filters++
+	}
+	if filters > 1 {
+		return fmt.Errorf("only one of --installed, --not-installed and --upgradable can be used")
+	}
+
+	site, err := openSite(c, pkg.LockShared)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	results, err := site.SearchPackages(strings.Join(c.Args().Slice(), " "), filter)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		out := []searchResultJSON{}
+		for _, r := range results {
+			out = append(out, searchResultJSON{
+				Name:        r.Package.Name(),
+				Version:     r.Package.Version(),
+				Category:    r.Package.Category(),
+				Summary:     r.Package.Summary(),
+				Description: r.Package.Description(),
+				Tags:        r.Package.Tags(),
+				Installed:   site.IsPackageInstalled(r.Package),
+				Score:       r.Score,
+				Matches:     r.Matches,
+			})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+
+	if len(results) == 0 {
+		fmt.Println("No packages found.")
+		return nil
+	}
+
+	yellow := color.New(color.Bold, color.FgYellow).SprintFunc()
+	green := color.New(color.Bold, color.FgGreen).SprintFunc()
+	for _, r := range results {
+		info := ""
+		if site.IsPackageInstalled(r.Package) {
+			info = green(" [installed]")
+		}
+		fmt.Printf("%s: %s%s\n",
+			highlight(r.Package.Name(), pkg.SearchFieldName, r.Matches, yellow),
+			highlight(r.Package.Summary(), pkg.SearchFieldSummary, r.Matches, yellow),
+			info,
+		)
+		for _, field := range []string{pkg.SearchFieldTags, pkg.SearchFieldDescription} {
+			for _, m := range r.Matches {
+				if m.Field == field {
+					text := pkg.SearchFieldText(r.Package, field)
+					fmt.Printf("    %s: %s\n", field, highlight(text, field, r.Matches, yellow))
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func siteInfo(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		return fmt.Errorf("wrong usage of site %s command", c.Command.Name)
+	}
+
+	mode := pkg.LockShared
+	if c.Command.Name == "init" {
+		mode = pkg.LockExclusive
+	}
+	site, err := openSite(c, mode)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	fmt.Printf("Site: %s\n", site.GetBaseDir())
+	fmt.Printf("Install prefix: %s\n", site.GetPrefix())
+	fmt.Printf("Rizin: %s\n", site.RizinBinary())
+	fmt.Printf("Rizin version: %s\n", site.RizinVersion())
+	return nil
+}
+
+func verifyPackages(c *cli.Context) error {
+	site, err := openSite(c, pkg.LockShared)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	report, err := site.VerifyPackages(c.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range report.Packages {
+		if len(r.Problems) > 0 {
+			failed++
+		}
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		green := color.New(color.Bold, color.FgGreen).SprintFunc()
+		red := color.New(color.Bold, color.FgRed).SprintFunc()
+		for _, r := range report.Packages {
+			status := green("OK")
+			if len(r.Problems) > 0 {
+				status = red(fmt.Sprintf("%d problems", len(r.Problems)))
+			}
+			if r.NoChecksums {
+				status += " (installed without checksums, only missing files are detected)"
+			}
+			fmt.Printf("%s: %s\n", r.Package, status)
+			for _, p := range r.Problems {
+				detail := ""
+				if p.Detail != "" {
+					detail = " (" + p.Detail + ")"
+				}
+				fmt.Printf("  %-9s %s%s\n", p.Kind+":", p.Path, detail)
+			}
+		}
+		if len(report.Unowned) > 0 {
+			fmt.Printf("Warning: %d files next to the installed files are not owned by any package:\n", len(report.Unowned))
+			for _, f := range report.Unowned {
+				fmt.Printf("  %s\n", f)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d installed packages failed verification", failed)
+	}
+	return nil
+}
+
+func fileOwners(c *cli.Context) error {
+	if c.Args().Len() < 1 {
+		cli.ShowCommandHelp(c, "owns")
+		return fmt.Errorf("wrong usage of owns command")
+	}
+
+	site, err := openSite(c, pkg.LockShared)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	notOwned := 0
+	for _, path := range c.Args().Slice() {
+		owners := site.FileOwners(path)
+		if len(owners) == 0 {
+			fmt.Printf("%s is not owned by any installed package\n", path)
+			notOwned++
+			continue
+		}
+		for _, owner := range owners {
+			fmt.Printf("%s is owned by %s %s\n", path, owner.Name(), owner.Version())
+		}
+	}
+
+	if notOwned > 0 {
+		return fmt.Errorf("%d files are not owned by any installed package", notOwned)
+	}
+	return nil
+}
+
+func envCreate(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" || c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "create")
+		return fmt.Errorf("wrong usage of env create command")
+	}
+
+	site, err := pkg.CreateEnv(name, siteOptions(c, pkg.LockExclusive))
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	fmt.Printf("Environment %s created in %s\n", name, site.GetBaseDir())
+	fmt.Printf("Run 'eval \"$(rz-pm env activate %s)\"' to use it.\n", name)
+	return nil
+}
+
+func envList(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "list")
+		return fmt.Errorf("wrong usage of env list command")
+	}
+
+	names, err := pkg.ListEnvs()
+	if err != nil {
+		return err
+	}
+
+	green := color.New(color.Bold, color.FgGreen).SprintFunc()
+	active := os.Getenv(pkg.EnvNameEnvVar)
+	for _, name := range names {
+		info := ""
+		if name == active {
+			info = green(" [active]")
+		}
+		fmt.Printf("%s%s\n", name, info)
+	}
+	return nil
+}
+
+func envActivate(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" || c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "activate")
+		return fmt.Errorf("wrong usage of env activate command")
+	}
+
+	path, err := pkg.EnvDir(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("environment %s does not exist", name)
+	}
+
+	// meant to be evaluated by the shell
+	fmt.Printf("export %s=%s\n", pkg.SiteDirEnvVar, shellQuote(path))
+	fmt.Printf("export %s=%s\n", pkg.EnvNameEnvVar, shellQuote(name))
+	return nil
+}
+
+// shellQuote quotes s for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func envRemove(c *cli.Context) error {
+	name := c.Args().First()
+	if name == "" || c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "remove")
+		return fmt.Errorf("wrong usage of env remove command")
+	}
+
+	// the database is not needed to remove the environment
+	opts := siteOptions(c, pkg.LockExclusive)
+	opts.UpdateDB = false
+	site, err := pkg.OpenEnv(name, opts)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	err = site.Remove()
+	if err != nil {
+		return fmt.Errorf("could not remove environment %s: %w", name, err)
+	}
+	fmt.Printf("Environment %s removed\n", name)
+	return nil
+}
+
+// execInEnv runs a command, usually rizin, with the plugins installed in an
+// environment, or in the current site.
+func execInEnv(c *cli.Context) error {
+	if c.Args().Len() < 1 {
+		cli.ShowCommandHelp(c, "exec")
+		return fmt.Errorf("wrong usage of exec command")
+	}
+
+	name := c.String("env")
+	if name == "" {
+		name = os.Getenv(pkg.EnvNameEnvVar)
+	}
+
+	// the database is not needed to run the command
+	opts := siteOptions(c, pkg.LockShared)
+	opts.UpdateDB = false
+	var site pkg.ManagedSite
+	var err error
+	if name != "" {
+		site, err = pkg.OpenEnv(name, opts)
+	} else {
+		site, err = initSite(pkg.SiteDir(), opts)
+	}
+	if err != nil {
+		return err
+	}
+	vars := pkg.EnvVars(site, name)
+	// do not keep other instances from modifying the site while the
+	// command runs
+	site.Close()
+
+	args := c.Args().Slice()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), vars...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
+	return err
+}
+
 func getNewRzPmVersion() (*version.Version, error) {
 	client := http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
-	resp, err := client.Get("https://github.com/rizinorg/rz-pm/releases/latest")
-	if err != nil {
-		return nil, err
+	resp, err := client.Get("https://github.com/rizinorg/rz-pm/releases/latest")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 302 {
+		return nil, fmt.Errorf("expected a redirection when querying releases/latest URL")
+	}
+	redirect_url, err := resp.Location()
+	if err != nil {
+		return nil, err
+	}
+	redirect_url_parts := strings.Split(redirect_url.Path, "/")
+	new_version_str := redirect_url_parts[len(redirect_url_parts)-1]
+
+	return version.NewVersion(new_version_str)
+}
+
+func getRzPmName() string {
+	name := "rz-pm-" + runtime.GOOS + "-"
+	if runtime.GOARCH == "amd64" {
+		name += "x86_64"
+	} else {
+		name += runtime.GOARCH
+	}
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func checkUpgrade(c *cli.Context) (bool, *version.Version, *version.Version, error) {
+	new_version, err := getNewRzPmVersion()
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	current_version, err := version.NewVersion(c.App.Version)
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	if new_version.LessThanOrEqual(current_version) {
+		return false, nil, nil, nil
+	}
+	return true, current_version, new_version, nil
+}
+
+func upgradeRzPm(c *cli.Context) error {
+	needsUpgrade, current_version, new_version, err := checkUpgrade(c)
+	if err != nil {
+		return nil
+	} else if !needsUpgrade {
+		fmt.Printf("You are already on the latest rz-pm version!\n")
+		return nil
+	}
+
+	fmt.Println("Your version of rz-pm is not the latest one.")
+	fmt.Printf("Currently installed version: %s, available version: %s\n", current_version, new_version)
+
+	fmt.Println("Downloading the new version...")
+	client := http.Client{}
+	rz_pm_name := getRzPmName()
+	resp, err := client.Get("https://github.com/rizinorg/rz-pm/releases/latest/download/" + rz_pm_name)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = update.Apply(resp.Body, update.Options{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Upgrade to rz-pm version %s was successful!\n", new_version)
+	return nil
+}
+
+// inGeneration runs fn, which changes the installed packages, and records
+// them as a new generation afterwards, even when fn fails half-way. The
+// packages installed before are recorded too, when they changed since the
+// current generation. It fails when fn fails or, otherwise, when the new
+// generation could not be recorded.
+func inGeneration(site pkg.ManagedSite, description string, fn func() error) error {
+	if _, err := site.RecordGeneration("before " + description); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not record the installed packages: %v\n", err)
+	}
+	err := fn()
+	if _, genErr := site.RecordGeneration(description); genErr != nil {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not record the installed packages: %v\n", genErr)
+		} else {
+			err = fmt.Errorf("could not record the installed packages: %w", genErr)
+		}
+	}
+	return err
+}
+
+func installPackages(c *cli.Context) error {
+	lockfile := c.String("from-lock")
+	if lockfile != "" && c.Args().Len() > 0 {
+		cli.ShowCommandHelp(c, "install")
+		return fmt.Errorf("wrong usage of install command, no package names can be given with --from-lock")
+	}
+	if lockfile == "" && c.Args().Len() < 1 {
+		cli.ShowCommandHelp(c, "install")
+		return fmt.Errorf("wrong usage of install command")
+	}
+
+	site, err := openSite(c, pkg.LockExclusive)
+	if err != nil {
+		return err
+	}
+	//multi-package installs shouldn't trigger site lock, so reused same instance
+	defer site.Close()
+
+	opts := pkg.InstallOptions{Force: c.Bool("force")}
+	if lockfile != "" {
+		lf, err := pkg.ReadLockfile(lockfile)
+		if err != nil {
+			return err
+		}
+		return inGeneration(site, "install --from-lock "+lockfile, func() error {
+			return site.InstallFromLockfile(lf, opts)
+		})
+	}
+
+	return inGeneration(site, "install "+strings.Join(c.Args().Slice(), " "), func() error {
+		return installPackageNames(c, site, opts)
+	})
+}
+
+func installPackageNames(c *cli.Context, site pkg.Site, opts pkg.InstallOptions) error {
+	var err error
+	for _, packageName := range c.Args().Slice() {
+		if packageName == "" {
+			cli.ShowCommandHelp(c, "install")
+			return fmt.Errorf("wrong usage of install command")
+		}
+
+		var p pkg.Package
+		if c.Bool("file") {
+			p, err = site.GetPackageFromFile(packageName)
+		} else {
+			p, err = site.GetPackage(packageName)
+		}
+		if err != nil {
+			return err
+		}
+
+		if c.Bool("clean") {
+			if err := site.CleanPackage(p); err != nil && !errors.Is(err, pkg.ErrNoArtifacts) {
+				return err
+			}
+		}
+
+		err = site.InstallPackage(p, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatSize formats a size in bytes with a binary unit, e.g. 1.5 MiB
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func collectGarbage(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "gc")
+		return fmt.Errorf("wrong usage of gc command")
+	}
+
+	opts := pkg.GCOptions{DryRun: c.Bool("dry-run"), KeepInstalled: c.Bool("keep-installed")}
+	mode := pkg.LockExclusive
+	if opts.DryRun {
+		mode = pkg.LockShared
+	}
+	site, err := openSite(c, mode)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	removed, err := site.CollectGarbage(opts)
+	var freed int64
+	for _, dir := range removed {
+		freed += dir.Size
+		action := "Removed"
+		if opts.DryRun {
+			action = "Would remove"
+		}
+		fmt.Printf("%s %s %s (%s)\n", action, dir.Package, dir.Version, formatSize(dir.Size))
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(removed) == 0 {
+		fmt.Println("Nothing to remove.")
+	} else if opts.DryRun {
+		fmt.Printf("%s would be freed.\n", formatSize(freed))
+	} else {
+		fmt.Printf("%s freed.\n", formatSize(freed))
+	}
+	return nil
+}
+
+func diskUsage(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "du")
+		return fmt.Errorf("wrong usage of du command")
+	}
+
+	site, err := openSite(c, pkg.LockShared)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	usage, err := site.DiskUsage()
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(usage)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tARTIFACTS\tINSTALLED")
+	var artifacts, installed int64
+	for _, u := range usage {
+		artifacts += u.Artifacts
+		installed += u.Installed
+		fmt.Fprintf(w, "%s\t%s\t%s\n", u.Package, formatSize(u.Artifacts), formatSize(u.Installed))
+	}
+	fmt.Fprintf(w, "total\t%s\t%s\n", formatSize(artifacts), formatSize(installed))
+	return w.Flush()
+}
+
+func showHistory(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "history")
+		return fmt.Errorf("wrong usage of history command")
+	}
+
+	site, err := openSite(c, pkg.LockShared)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	entries, err := site.History()
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	green := color.New(color.Bold, color.FgGreen).SprintFunc()
+	red := color.New(color.Bold, color.FgRed).SprintFunc()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tUSER\tOPERATION\tPACKAGE\tVERSION\tRIZIN\tRESULT")
+	for _, e := range entries {
+		operation := e.Operation
+		if e.Generation != 0 {
+			operation += fmt.Sprintf(" to generation %d", e.Generation)
+		}
+		if e.Undo != 0 {
+			operation += fmt.Sprintf(" (undo of %d)", e.Undo)
+		}
+		result := green(e.Result)
+		if e.Result != pkg.HistoryOK {
+			result = red(e.Result) + ": " + e.Error
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.Time.Local().Format("2006-01-02 15:04:05"),
+			e.User, operation, e.Package, e.Version, e.RizinVersion, result)
+	}
+	return w.Flush()
+}
+
+func undoHistory(c *cli.Context) error {
+	id, err := strconv.Atoi(c.Args().First())
+	if err != nil || c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "undo")
+		return fmt.Errorf("wrong usage of history undo command")
+	}
+
+	site, err := openSite(c, pkg.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	return inGeneration(site, fmt.Sprintf("history undo %d", id), func() error {
+		return site.UndoHistory(id)
+	})
+}
+
+func setPackagesDisabled(c *cli.Context, disable bool) error {
+	command := "enable"
+	if disable {
+		command = "disable"
+	}
+	if c.Args().Len() < 1 {
+		cli.ShowCommandHelp(c, command)
+		return fmt.Errorf("wrong usage of %s command", command)
+	}
+
+	site, err := openSite(c, pkg.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	for _, name := range c.Args().Slice() {
+		if disable {
+			err = site.DisablePackage(name)
+		} else {
+			err = site.EnablePackage(name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Package %s %sd.\n", name, command)
+	}
+	return nil
+}
+
+func disablePackages(c *cli.Context) error {
+	return setPackagesDisabled(c, true)
+}
+
+func enablePackages(c *cli.Context) error {
+	return setPackagesDisabled(c, false)
+}
+
+func checkPackages(c *cli.Context) error {
+	site, err := openSite(c, pkg.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	results, err := site.CheckPackages(c.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	broken := 0
+	for _, r := range results {
+		if r.Broken {
+			broken++
+		}
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		green := color.New(color.Bold, color.FgGreen).SprintFunc()
+		red := color.New(color.Bold, color.FgRed).SprintFunc()
+		for _, r := range results {
+			switch {
+			case r.Broken:
+				fmt.Printf("%s: %s\n", r.Package, red("broken"))
+			case len(r.Plugins) == 0:
+				fmt.Printf("%s: %s (no plugins)\n", r.Package, green("OK"))
+			default:
+				fmt.Printf("%s: %s\n", r.Package, green("OK"))
+			}
+			for _, p := range r.Plugins {
+				if p.Loaded {
+					continue
+				}
+				fmt.Printf("  %s: not loaded\n", p.Path)
+				if p.Error != "" {
+					fmt.Printf("    %s\n", strings.ReplaceAll(p.Error, "\n", "\n    "))
+				}
+			}
+		}
+	}
+
+	if broken > 0 {
+		return fmt.Errorf("%d packages have plugins that rizin cannot load", broken)
+	}
+	return nil
+}
+
+func doctor(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "doctor")
+		return fmt.Errorf("wrong usage of doctor command")
+	}
+
+	checks := pkg.Diagnose(pkg.SiteDir(), siteOptions(c, pkg.LockShared))
+	failed := 0
+	for _, check := range checks {
+		if check.Status == pkg.CheckError {
+			failed++
+		}
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(checks); err != nil {
+			return err
+		}
+	} else {
+		green := color.New(color.Bold, color.FgGreen).SprintFunc()
+		yellow := color.New(color.Bold, color.FgYellow).SprintFunc()
+		red := color.New(color.Bold, color.FgRed).SprintFunc()
+		for _, check := range checks {
+			status := green("[ok]")
+			switch check.Status {
+			case pkg.CheckWarning:
+				status = yellow("[warning]")
+			case pkg.CheckError:
+				status = red("[error]")
+			}
+			fmt.Printf("%s %s: %s\n", status, check.Name, check.Detail)
+			if check.Fix != "" {
+				fmt.Printf("    fix: %s\n", check.Fix)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d problems found", failed)
+	}
+	return nil
+}
+
+func exportPackages(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "export")
+		return fmt.Errorf("wrong usage of export command")
+	}
+
+	site, err := openSite(c, pkg.LockShared)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	lf, err := site.ExportLockfile()
+	if err != nil {
+		return err
+	}
+	output := c.String("output")
+	if output == "" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(lf)
+	}
+	by, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, append(by, '\n'), 0644)
+}
+
+func outdatedPackages(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "outdated")
+		return fmt.Errorf("wrong usage of outdated command")
+	}
+
+	site, err := openSite(c, pkg.LockShared)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	outdated, err := site.ListOutdatedPackages()
+	if err != nil {
+		return err
+	}
+	if len(outdated) == 0 {
+		fmt.Println("All installed packages are up to date.")
+		return nil
+	}
+
+	green := color.New(color.Bold, color.FgGreen).SprintFunc()
+	for _, o := range outdated {
+		installed := o.Installed.Version()
+		if installed == "" {
+			installed = "unknown version"
+		}
+		fmt.Printf("%s: %s -> %s\n", o.Installed.Name(), installed, green(o.Available.Version()))
+	}
+	return nil
+}
+
+func upgradePackages(c *cli.Context) error {
+	site, err := openSite(c, pkg.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	outdated, err := site.ListOutdatedPackages()
+	if err != nil {
+		return err
+	}
+	available := map[string]pkg.Package{}
+	names := []string{}
+	for _, o := range outdated {
+		available[o.Installed.Name()] = o.Available
+		names = append(names, o.Installed.Name())
+	}
+	if c.Args().Len() > 0 {
+		names = c.Args().Slice()
+	}
+	if len(names) == 0 {
+		fmt.Println("All installed packages are up to date.")
+		return nil
+	}
+
+	opts := pkg.InstallOptions{Force: c.Bool("force")}
+	return inGeneration(site, "upgrade-packages "+strings.Join(names, " "), func() error {
+		return upgradePackageNames(site, names, available, opts)
+	})
+}
+
+func upgradePackageNames(site pkg.ManagedSite, names []string, available map[string]pkg.Package, opts pkg.InstallOptions) error {
+	for _, name := range names {
+		p, ok := available[name]
+		if !ok {
+			var err error
+			p, err = site.GetPackage(name)
+			if err != nil {
+				return err
+			}
+			if !site.IsPackageInstalled(p) {
+				return fmt.Errorf("package %s not installed", name)
+			}
+			fmt.Printf("Package %s is already up to date.\n", name)
+			continue
+		}
+
+		fmt.Printf("Upgrading %s to version %s...\n", name, p.Version())
+		if err := site.UpgradePackage(p, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generationsList(c *cli.Context) error {
+	if c.Args().Len() != 0 {
+		cli.ShowCommandHelp(c, "list")
+		return fmt.Errorf("wrong usage of generations list command")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 302 {
-		return nil, fmt.Errorf("expected a redirection when querying releases/latest URL")
+	site, err := openSite(c, pkg.LockShared)
+	if err != nil {
+		return err
 	}
-	redirect_url, err := resp.Location()
+	defer site.Close()
+
+	generations, err := site.ListGenerations()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(generations)
 	}
-	redirect_url_parts := strings.Split(redirect_url.Path, "/")
-	new_version_str := redirect_url_parts[len(redirect_url_parts)-1]
 
-	return version.NewVersion(new_version_str)
+	green := color.New(color.Bold, color.FgGreen).SprintFunc()
+	for _, g := range generations {
+		info := ""
+		if g.Current {
+			info = green(" [current]")
+		}
+		packages := []string{}
+		for _, p := range g.Packages {
+			packages = append(packages, p.Name()+" "+p.Version())
+		}
+		fmt.Printf("%d  %s  %s%s\n", g.ID, g.Created.Local().Format("2006-01-02 15:04:05"), g.Description, info)
+		if len(packages) > 0 {
+			fmt.Printf("    %s\n", strings.Join(packages, ", "))
+		}
+	}
+	return nil
 }
 
-func getRzPmName() string {
-	name := "rz-pm-" + runtime.GOOS + "-"
-	if runtime.GOARCH == "amd64" {
-		name += "x86_64"
-	} else {
-		name += runtime.GOARCH
-	}
-	if runtime.GOOS == "windows" {
-		name += ".exe"
+// generationID parses the only argument of the generations subcommand name
+func generationID(c *cli.Context, name string) (int, error) {
+	id, err := strconv.Atoi(c.Args().First())
+	if err != nil || c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, name)
+		return 0, fmt.Errorf("wrong usage of generations %s command", name)
 	}
-	return name
+	return id, nil
 }
 
-func checkUpgrade(c *cli.Context) (bool, *version.Version, *version.Version, error) {
-	new_version, err := getNewRzPmVersion()
+func generationsSwitch(c *cli.Context) error {
+	id, err := generationID(c, "switch")
 	if err != nil {
-		return false, nil, nil, err
+		return err
 	}
 
-	current_version, err := version.NewVersion(c.App.Version)
+	site, err := openSite(c, pkg.LockExclusive)
 	if err != nil {
-		return false, nil, nil, err
+		return err
 	}
+	defer site.Close()
 
-	if new_version.LessThanOrEqual(current_version) {
-		return false, nil, nil, nil
-	}
-	return true, current_version, new_version, nil
+	return site.SwitchGeneration(id)
 }
 
-func upgradeRzPm(c *cli.Context) error {
-	needsUpgrade, current_version, new_version, err := checkUpgrade(c)
+func generationsDelete(c *cli.Context) error {
+	id, err := generationID(c, "delete")
 	if err != nil {
-		return nil
-	} else if !needsUpgrade {
-		fmt.Printf("You are already on the latest rz-pm version!\n")
-		return nil
+		return err
 	}
 
-	fmt.Println("Your version of rz-pm is not the latest one.")
-	fmt.Printf("Currently installed version: %s, available version: %s\n", current_version, new_version)
-
-	fmt.Println("Downloading the new version...")
-	client := http.Client{}
-	rz_pm_name := getRzPmName()
-	resp, err := client.Get("https://github.com/rizinorg/rz-pm/releases/latest/download/" + rz_pm_name)
+	site, err := openSite(c, pkg.LockExclusive)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer site.Close()
 
-	err = update.Apply(resp.Body, update.Options{})
-	if err != nil {
+	if err := site.DeleteGeneration(id); err != nil {
 		return err
 	}
-	fmt.Printf("Upgrade to rz-pm version %s was successful!\n", new_version)
+	fmt.Printf("Generation %d deleted.\n", id)
 	return nil
 }
 
-func installPackages(c *cli.Context) error {
-	if c.Args().Len() < 1 {
-		cli.ShowCommandHelp(c, "install")
-		return fmt.Errorf("wrong usage of install command")
+func rollbackPackage(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "rollback")
+		return fmt.Errorf("wrong usage of rollback command")
 	}
 
-	site, err := initSite(pkg.SiteDir(), c.Bool(flagUpdateDB))
+	site, err := openSite(c, pkg.LockExclusive)
 	if err != nil {
 		return err
 	}
-	//multi-package installs shouldn't trigger site lock, so reused same instance
 	defer site.Close()
 
-	for _, packageName := range c.Args().Slice() {
-		if packageName == "" {
-			cli.ShowCommandHelp(c, "install")
-			return fmt.Errorf("wrong usage of install command")
-		}
+	name := c.Args().First()
+	return inGeneration(site, "rollback "+name, func() error {
+		return site.RollbackPackage(name)
+	})
+}
 
-		var pkg pkg.Package
-		if c.Bool("file") {
-			pkg, err = site.GetPackageFromFile(packageName)
-		} else {
-			pkg, err = site.GetPackage(packageName)
+func rebuildPackages(c *cli.Context) error {
+	outdated := c.Bool("outdated")
+	if outdated == (c.Args().Len() > 0) || (outdated && c.Bool("file")) {
+		cli.ShowCommandHelp(c, "rebuild")
+		return fmt.Errorf("wrong usage of rebuild command, pass either --outdated or package names")
+	}
+
+	site, err := openSite(c, pkg.LockExclusive)
+	if err != nil {
+		return err
+	}
+	defer site.Close()
+
+	names := c.Args().Slice()
+	if outdated {
+		for _, p := range site.ListPackagesToRebuild() {
+			names = append(names, p.Name())
 		}
-		if err != nil {
-			return err
+		if len(names) == 0 {
+			fmt.Printf("All installed packages are built for rizin v%s.\n", pkg.GetMajorMinorVersion(site.RizinVersion()))
+			return nil
 		}
+	}
 
-		if c.Bool("clean") {
-			site.CleanPackage(pkg)
+	opts := pkg.RebuildOptions{Upgrade: c.Bool("upgrade")}
+	failures := map[string]error{}
+	genErr := inGeneration(site, "rebuild "+strings.Join(names, " "), func() error {
+		for _, name := range names {
+			var p pkg.Package
+			if c.Bool("file") {
+				p, err = site.GetPackageFromFile(name)
+			} else {
+				p, err = site.GetPackage(name)
+			}
+			if err == nil {
+				err = site.RebuildPackage(p, opts)
+			}
+			if err != nil {
+				fmt.Printf("Failed to rebuild %s: %v\n", name, err)
+				failures[name] = err
+			}
 		}
+		return nil
+	})
 
-		err = site.InstallPackage(pkg)
-		if err != nil {
-			return err
+	green := color.New(color.Bold, color.FgGreen).SprintFunc()
+	red := color.New(color.Bold, color.FgRed).SprintFunc()
+	fmt.Println("Rebuild summary:")
+	for _, name := range names {
+		if err, ok := failures[name]; ok {
+			fmt.Printf("  %s: %s (%v)\n", name, red("failed"), err)
+		} else {
+			fmt.Printf("  %s: %s\n", name, green("rebuilt"))
 		}
 	}
-	return nil
+	if len(failures) > 0 {
+		return fmt.Errorf("%d packages failed to rebuild", len(failures))
+	}
+	return genErr
 }
 
 func uninstallPackages(c *cli.Context) error {
@@ -250,13 +1362,20 @@ func uninstallPackages(c *cli.Context) error {
 		return fmt.Errorf("wrong usage of uninstall command")
 	}
 
-	site, err := initSite(pkg.SiteDir(), c.Bool(flagUpdateDB))
+	site, err := openSite(c, pkg.LockExclusive)
 	if err != nil {
 		return err
 	}
 	//same as in install above
 	defer site.Close()
 
+	return inGeneration(site, "uninstall "+strings.Join(c.Args().Slice(), " "), func() error {
+		return uninstallPackageNames(c, site)
+	})
+}
+
+func uninstallPackageNames(c *cli.Context, site pkg.Site) error {
+	var err error
 	for _, packageName := range c.Args().Slice() {
 		if packageName == "" {
 			cli.ShowCommandHelp(c, "uninstall")
@@ -288,7 +1407,7 @@ func cleanPackage(c *cli.Context) error {
 		return fmt.Errorf("wrong usage of clean command")
 	}
 
-	site, err := initSite(pkg.SiteDir(), c.Bool(flagUpdateDB))
+	site, err := openSite(c, pkg.LockExclusive)
 	if err != nil {
 		return err
 	}
@@ -323,6 +1442,7 @@ func main() {
 	app.Name = "rz-pm"
 	app.Usage = "Rizin package manager"
 	app.Version = "v0.3.6"
+	pkg.RzPmVersion = app.Version
 
 	cli.AppHelpTemplate = fmt.Sprintf(`%s
 RZ_PM_SITE:
@@ -344,10 +1464,41 @@ RZ_PM_SITE:
 			Usage: "Update the DB?",
 			Value: true,
 		},
+		&cli.BoolFlag{
+			Name:    flagDBSummary,
+			Usage:   "print the packages changed by a database update",
+			EnvVars: []string{"RZPM_DB_SUMMARY"},
+		},
+		&cli.StringFlag{
+			Name:    flagPrefix,
+			Usage:   "install prefix of a new site: home (~/.local), site (inside the site directory), system (the prefix of rizin) or an absolute path",
+			EnvVars: []string{"RZPM_PREFIX"},
+		},
+		&cli.StringFlag{
+			Name:    flagDBBranch,
+			Usage:   "use the given rz-pm-db branch instead of the one matching the rizin version",
+			EnvVars: []string{"RZPM_DB_BRANCH"},
+		},
+		&cli.StringFlag{
+			Name:    flagRizin,
+			Usage:   "rizin binary to install packages for, by default the one in PATH",
+			EnvVars: []string{"RZPM_RIZIN"},
+		},
+		&cli.BoolFlag{
+			Name:    flagPerRizin,
+			Usage:   "use a separate site when the selected rizin differs from the one the site was created for",
+			EnvVars: []string{"RZPM_PER_RIZIN_SITE"},
+		},
+		&cli.BoolFlag{
+			Name:    flagWait,
+			Usage:   "wait for other rz-pm instances to release the site instead of failing",
+			EnvVars: []string{"RZPM_WAIT"},
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
 		setDebug(c.Bool(flagNameDebug))
+		pkg.RZPM_DB_BRANCH = c.String(flagDBBranch)
 
 		if !c.Bool(flagSkipUpgrade) && c.Args().First() != "upgrade" {
 			needsUpgrade, current_version, new_version, err := checkUpgrade(c)
@@ -367,6 +1518,12 @@ RZ_PM_SITE:
 		return nil
 	}
 
+	categoryFlag := &cli.StringSliceFlag{
+		Name:    flagCategory,
+		Aliases: []string{"c"},
+		Usage:   "only list packages in the given category (e.g. arch, bin/elf)",
+	}
+
 	app.Commands = []*cli.Command{
 		{
 			Name:      "install",
@@ -382,6 +1539,14 @@ RZ_PM_SITE:
 					Name:  "file",
 					Usage: "install a local file(s)",
 				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "install even if the package overwrites files of other packages",
+				},
+				&cli.StringFlag{
+					Name:  "from-lock",
+					Usage: "install exactly the packages of a lockfile written by the export command",
+				},
 			},
 		},
 		{
@@ -389,16 +1554,19 @@ RZ_PM_SITE:
 			Aliases: []string{"ls"},
 			Usage:   "list packages",
 			Action:  listAvailablePackages,
+			Flags:   []cli.Flag{categoryFlag},
 			Subcommands: []*cli.Command{
 				{
 					Name:   "available",
 					Usage:  "list all available packages",
 					Action: listAvailablePackages,
+					Flags:  []cli.Flag{categoryFlag},
 				},
 				{
 					Name:   "installed",
 					Usage:  "list installed packages",
 					Action: listInstalledPackages,
+					Flags:  []cli.Flag{categoryFlag},
 				},
 			},
 		},
@@ -437,6 +1605,291 @@ RZ_PM_SITE:
 				},
 			},
 		},
+		{
+			Name:  "site",
+			Usage: "manage the rz-pm site",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "init",
+					Usage:  "create the site, use the global --prefix flag to choose its install prefix",
+					Action: siteInfo,
+				},
+				{
+					Name:   "info",
+					Usage:  "show the site properties",
+					Action: siteInfo,
+				},
+			},
+		},
+		{
+			Name:      "disable",
+			Usage:     "stop rizin from loading the plugins of installed packages, without uninstalling them",
+			ArgsUsage: "<package-name> [<package-name> ...]",
+			Action:    disablePackages,
+		},
+		{
+			Name:      "enable",
+			Usage:     "let rizin load again the plugins of disabled packages",
+			ArgsUsage: "<package-name> [<package-name> ...]",
+			Action:    enablePackages,
+		},
+		{
+			Name:      "check",
+			Usage:     "check that rizin loads the plugins of installed packages, all of them by default",
+			ArgsUsage: "[<package-name> ...]",
+			Action:    checkPackages,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the results as JSON",
+				},
+			},
+		},
+		{
+			Name:   "doctor",
+			Usage:  "check that everything needed to build and install packages is in place",
+			Action: doctor,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the checks as JSON",
+				},
+			},
+		},
+		{
+			Name:   "gc",
+			Usage:  "remove the build artifacts of uninstalled packages and of old versions",
+			Action: collectGarbage,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only show what would be removed",
+				},
+				&cli.BoolFlag{
+					Name:  "keep-installed",
+					Usage: "keep the artifacts of the installed versions, even if newer ones are available",
+				},
+			},
+		},
+		{
+			Name:   "du",
+			Usage:  "show the disk space used by the artifacts and the installed files of each package",
+			Action: diskUsage,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the disk usage as JSON",
+				},
+			},
+		},
+		{
+			Name:   "export",
+			Usage:  "print a lockfile of the installed packages, to install the same ones elsewhere",
+			Action: exportPackages,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "write the lockfile to the given file instead of printing it",
+				},
+			},
+		},
+		{
+			Name:   "outdated",
+			Usage:  "list the installed packages with a newer version available",
+			Action: outdatedPackages,
+		},
+		{
+			Name:      "upgrade-packages",
+			Usage:     "upgrade installed packages to their latest version, all the outdated ones by default",
+			ArgsUsage: "[<package-name> ...]",
+			Action:    upgradePackages,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "upgrade even if the new version overwrites files of other packages",
+				},
+			},
+		},
+		{
+			Name:      "rollback",
+			Usage:     "restore the installation of a package before its last upgrade or rebuild",
+			ArgsUsage: "<package-name>",
+			Action:    rollbackPackage,
+		},
+		{
+			Name:   "history",
+			Usage:  "show the install, uninstall, clean, upgrade and rebuild operations done on the site",
+			Action: showHistory,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the history as JSON",
+				},
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:      "undo",
+					Usage:     "revert an install or uninstall, without building anything",
+					ArgsUsage: "<id>",
+					Action:    undoHistory,
+				},
+			},
+		},
+		{
+			Name:  "generations",
+			Usage: "manage the generations of the installed packages, recorded after each change",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the generations",
+					Action: generationsList,
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "json",
+							Usage: "print the generations as JSON",
+						},
+					},
+				},
+				{
+					Name:      "switch",
+					Usage:     "install the packages of a generation, restoring their files without building them",
+					ArgsUsage: "<id>",
+					Description: "The files of the packages are replaced one at a time, and the installed\n" +
+						"packages are recorded once they are all in place. The switch is not atomic:\n" +
+						"if it fails the previous files are restored, but if rz-pm is interrupted\n" +
+						"half-way the install prefix can mix the files of both generations until\n" +
+						"the same switch is run again.",
+					Action: generationsSwitch,
+				},
+				{
+					Name:      "delete",
+					Usage:     "delete a generation and the files only it references",
+					ArgsUsage: "<id>",
+					Action:    generationsDelete,
+				},
+			},
+		},
+		{
+			Name:      "rebuild",
+			Usage:     "rebuild and reinstall packages, e.g. after upgrading rizin",
+			ArgsUsage: "--outdated | <package-name> [<package-name> ...]",
+			Action:    rebuildPackages,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "outdated",
+					Usage: "rebuild every package built against an older rizin version",
+				},
+				&cli.BoolFlag{
+					Name:  "upgrade",
+					Usage: "rebuild the release in the database even when it is not the installed one",
+				},
+				&cli.BoolFlag{
+					Name:  "file",
+					Usage: "rebuild local file(s)",
+				},
+			},
+		},
+		{
+			Name:      "owns",
+			Usage:     "show which installed package installed a file",
+			ArgsUsage: "<path> [<path> ...]",
+			Action:    fileOwners,
+		},
+		{
+			Name:      "verify",
+			Usage:     "check the installed files for missing, modified or extra files",
+			ArgsUsage: "[<package-name> ...]",
+			Action:    verifyPackages,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the results as JSON",
+				},
+			},
+		},
+		{
+			Name:  "env",
+			Usage: "manage environments, i.e. separate sites with their own set of plugins",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "create",
+					Usage:     "create an environment",
+					ArgsUsage: "<name>",
+					Action:    envCreate,
+				},
+				{
+					Name:   "list",
+					Usage:  "list the environments",
+					Action: envList,
+				},
+				{
+					Name:      "activate",
+					Usage:     "print the shell commands to use an environment, run as: eval \"$(rz-pm env activate <name>)\"",
+					ArgsUsage: "<name>",
+					Action:    envActivate,
+				},
+				{
+					Name:      "remove",
+					Usage:     "remove an environment and all the plugins installed in it",
+					ArgsUsage: "<name>",
+					Action:    envRemove,
+				},
+			},
+		},
+		{
+			Name:      "exec",
+			Usage:     "run a command with the plugins of an environment, e.g. rz-pm exec --env work -- rizin /bin/ls",
+			ArgsUsage: "-- <command> [<argument> ...]",
+			Action:    execInEnv,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "env",
+					Usage: "environment to use instead of the active one",
+				},
+			},
+		},
+		{
+			Name:  "db",
+			Usage: "manage the package database",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "changes",
+					Usage:  "show the packages changed by the last database update",
+					Action: databaseChanges,
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "json",
+							Usage: "print the changes as JSON",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:      "search",
+			Usage:     "search packages by name, summary, description and tags",
+			ArgsUsage: "<query>",
+			Action:    searchPackages,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "installed",
+					Usage: "only search installed packages",
+				},
+				&cli.BoolFlag{
+					Name:  "not-installed",
+					Usage: "only search packages that are not installed",
+				},
+				&cli.BoolFlag{
+					Name:  "upgradable",
+					Usage: "only search installed packages with a newer version available",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the results as JSON",
+				},
+			},
+		},
 		{
 			Name:   "upgrade",
 			Usage:  "upgrade rz-pm",
@@ -446,6 +1899,9 @@ RZ_PM_SITE:
 
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		if errors.Is(err, pkg.ErrSiteLocked) {
+			fmt.Fprintln(os.Stderr, "Site directory is in use by another instance of rz-pm, use --wait to wait for it to finish.")
+		}
 		os.Exit(1)
 	}
 }
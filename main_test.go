@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"fmt"
+	"path/filepath"
+	"runtime"
 	"testing"
 
 	rzpmPkg "github.com/rizinorg/rz-pm/pkg"
@@ -19,6 +21,8 @@ func (p fakeCLIPackage) Name() string                           { return p.name
 func (p fakeCLIPackage) Version() string                        { return "0.0.1" }
 func (p fakeCLIPackage) Summary() string                        { return "" }
 func (p fakeCLIPackage) Description() string                    { return "" }
+func (p fakeCLIPackage) Category() string                       { return "" }
+func (p fakeCLIPackage) Tags() []string                         { return nil }
 func (p fakeCLIPackage) Source() rzpmPkg.RizinPackageSource     { return rzpmPkg.RizinPackageSource{} }
 func (p fakeCLIPackage) Download(string) error                  { return nil }
 func (p fakeCLIPackage) Build(rzpmPkg.Site) error               { return nil }
@@ -30,8 +34,15 @@ type fakeCLISite struct {
 	installCalls    []string
 	uninstallCalls  []string
 	cleanCalls      []string
+	cleanErrs       map[string]error
 	closeCalls      int
 	getPackageCalls []string
+	rebuildCalls    []string
+	toRebuild       []rzpmPkg.InstalledPackage
+	installed       map[string]bool
+	outdated        []rzpmPkg.OutdatedPackage
+	upgradeCalls    []string
+	generations     []string
 }
 
 func (s *fakeCLISite) ListAvailablePackages() ([]rzpmPkg.Package, error) {
@@ -40,7 +51,9 @@ func (s *fakeCLISite) ListAvailablePackages() ([]rzpmPkg.Package, error) {
 func (s *fakeCLISite) ListInstalledPackages() ([]rzpmPkg.Package, error) {
 	return []rzpmPkg.Package{}, nil
 }
-func (s *fakeCLISite) IsPackageInstalled(rzpmPkg.Package) bool { return false }
+func (s *fakeCLISite) IsPackageInstalled(pkg rzpmPkg.Package) bool {
+	return s.installed[pkg.Name()]
+}
 func (s *fakeCLISite) GetPackage(name string) (rzpmPkg.Package, error) {
 	s.getPackageCalls = append(s.getPackageCalls, name)
 	pkg, ok := s.packages[name]
@@ -57,7 +70,8 @@ func (s *fakeCLISite) GetBaseDir() string      { return "" }
 func (s *fakeCLISite) GetArtifactsDir() string { return "" }
 func (s *fakeCLISite) GetPkgConfigDir() string { return "" }
 func (s *fakeCLISite) GetCMakeDir() string     { return "" }
-func (s *fakeCLISite) InstallPackage(pkg rzpmPkg.Package) error {
+func (s *fakeCLISite) GetPrefix() string       { return "" }
+func (s *fakeCLISite) InstallPackage(pkg rzpmPkg.Package, opts rzpmPkg.InstallOptions) error {
 	s.installCalls = append(s.installCalls, pkg.Name())
 	return nil
 }
@@ -67,11 +81,73 @@ func (s *fakeCLISite) UninstallPackage(pkg rzpmPkg.Package) error {
 }
 func (s *fakeCLISite) CleanPackage(pkg rzpmPkg.Package) error {
 	s.cleanCalls = append(s.cleanCalls, pkg.Name())
-	return nil
+	return s.cleanErrs[pkg.Name()]
 }
 func (s *fakeCLISite) Remove() error        { return nil }
 func (s *fakeCLISite) RizinVersion() string { return "0.9.0" }
+func (s *fakeCLISite) RizinBinary() string  { return "rizin" }
 func (s *fakeCLISite) Close() error         { s.closeCalls++; return nil }
+func (s *fakeCLISite) SearchPackages(string, rzpmPkg.SearchFilter) ([]rzpmPkg.SearchResult, error) {
+	return []rzpmPkg.SearchResult{}, nil
+}
+func (s *fakeCLISite) DatabaseChanges() (rzpmPkg.DatabaseChanges, error) {
+	return rzpmPkg.DatabaseChanges{}, nil
+}
+func (s *fakeCLISite) VerifyPackages([]string) (rzpmPkg.VerifyReport, error) {
+	return rzpmPkg.VerifyReport{Packages: []rzpmPkg.VerifyResult{}, Unowned: []string{}}, nil
+}
+func (s *fakeCLISite) FileOwners(string) []rzpmPkg.InstalledPackage {
+	return []rzpmPkg.InstalledPackage{}
+}
+func (s *fakeCLISite) CheckFileConflicts(string, []string) error { return nil }
+func (s *fakeCLISite) ListPackagesToRebuild() []rzpmPkg.InstalledPackage {
+	return s.toRebuild
+}
+func (s *fakeCLISite) RebuildPackage(pkg rzpmPkg.Package, opts rzpmPkg.RebuildOptions) error {
+	s.rebuildCalls = append(s.rebuildCalls, pkg.Name())
+	if pkg.Name() == "broken" {
+		return fmt.Errorf("build failed")
+	}
+	return nil
+}
+func (s *fakeCLISite) ListOutdatedPackages() ([]rzpmPkg.OutdatedPackage, error) {
+	return s.outdated, nil
+}
+func (s *fakeCLISite) UpgradePackage(pkg rzpmPkg.Package, opts rzpmPkg.InstallOptions) error {
+	s.upgradeCalls = append(s.upgradeCalls, pkg.Name())
+	return nil
+}
+func (s *fakeCLISite) RollbackPackage(string) error { return nil }
+func (s *fakeCLISite) ExportLockfile() (rzpmPkg.Lockfile, error) {
+	return rzpmPkg.Lockfile{Version: 1, RizinVersion: "0.8.1", Packages: []rzpmPkg.LockedPackage{}}, nil
+}
+func (s *fakeCLISite) InstallFromLockfile(rzpmPkg.Lockfile, rzpmPkg.InstallOptions) error {
+	return nil
+}
+func (s *fakeCLISite) CollectGarbage(rzpmPkg.GCOptions) ([]rzpmPkg.ArtifactDir, error) {
+	return []rzpmPkg.ArtifactDir{}, nil
+}
+func (s *fakeCLISite) DiskUsage() ([]rzpmPkg.PackageUsage, error) {
+	return []rzpmPkg.PackageUsage{}, nil
+}
+func (s *fakeCLISite) DisablePackage(string) error { return nil }
+func (s *fakeCLISite) EnablePackage(string) error  { return nil }
+func (s *fakeCLISite) CheckPackages([]string) ([]rzpmPkg.PluginCheck, error) {
+	return []rzpmPkg.PluginCheck{}, nil
+}
+func (s *fakeCLISite) RecordGeneration(description string) (bool, error) {
+	s.generations = append(s.generations, description)
+	return true, nil
+}
+func (s *fakeCLISite) ListGenerations() ([]rzpmPkg.Generation, error) {
+	return []rzpmPkg.Generation{}, nil
+}
+func (s *fakeCLISite) SwitchGeneration(int) error { return nil }
+func (s *fakeCLISite) DeleteGeneration(int) error { return nil }
+func (s *fakeCLISite) History() ([]rzpmPkg.HistoryEntry, error) {
+	return []rzpmPkg.HistoryEntry{}, nil
+}
+func (s *fakeCLISite) UndoHistory(int) error { return nil }
 
 func newCLIContext(t *testing.T, args []string, includeClean bool) *cli.Context {
 	t.Helper()
@@ -99,7 +175,7 @@ func TestInstallPackagesUsesSingleSite(t *testing.T) {
 		},
 	}
 	initCalls := 0
-	initSite = func(string, bool) (rzpmPkg.Site, error) {
+	initSite = func(string, rzpmPkg.SiteOptions) (rzpmPkg.ManagedSite, error) {
 		initCalls++
 		return site, nil
 	}
@@ -115,6 +191,32 @@ func TestInstallPackagesUsesSingleSite(t *testing.T) {
 	assert.Equal(t, []string{"first", "second"}, site.installCalls)
 }
 
+func TestInstallPackagesClean(t *testing.T) {
+	originalInitSite := initSite
+	defer func() { initSite = originalInitSite }()
+
+	site := &fakeCLISite{
+		packages: map[string]rzpmPkg.Package{
+			"built":  fakeCLIPackage{name: "built"},
+			"locked": fakeCLIPackage{name: "locked"},
+		},
+		cleanErrs: map[string]error{
+			"built":  fmt.Errorf("%w for package built", rzpmPkg.ErrNoArtifacts),
+			"locked": fmt.Errorf("permission denied"),
+		},
+	}
+	initSite = func(string, rzpmPkg.SiteOptions) (rzpmPkg.ManagedSite, error) {
+		return site, nil
+	}
+
+	require.NoError(t, installPackages(newCLIContext(t, []string{"--clean", "built"}, true)), "packages without artifacts are installed")
+	assert.Equal(t, []string{"built"}, site.installCalls)
+
+	err := installPackages(newCLIContext(t, []string{"--clean", "locked"}, true))
+	assert.ErrorContains(t, err, "permission denied")
+	assert.Equal(t, []string{"built"}, site.installCalls, "packages that could not be cleaned should not be installed")
+}
+
 func TestUninstallPackagesUsesSingleSite(t *testing.T) {
 	originalInitSite := initSite
 	defer func() { initSite = originalInitSite }()
@@ -126,7 +228,7 @@ func TestUninstallPackagesUsesSingleSite(t *testing.T) {
 		},
 	}
 	initCalls := 0
-	initSite = func(string, bool) (rzpmPkg.Site, error) {
+	initSite = func(string, rzpmPkg.SiteOptions) (rzpmPkg.ManagedSite, error) {
 		initCalls++
 		return site, nil
 	}
@@ -139,4 +241,126 @@ func TestUninstallPackagesUsesSingleSite(t *testing.T) {
 	assert.Equal(t, 1, site.closeCalls, "site should be closed once")
 	assert.Equal(t, []string{"first", "second"}, site.getPackageCalls)
 	assert.Equal(t, []string{"first", "second"}, site.uninstallCalls)
+	assert.Equal(t, []string{"before uninstall first second", "uninstall first second"}, site.generations,
+		"the installed packages should be recorded around the transaction")
+}
+
+func TestLockModes(t *testing.T) {
+	originalInitSite := initSite
+	defer func() { initSite = originalInitSite }()
+
+	site := &fakeCLISite{
+		packages: map[string]rzpmPkg.Package{
+			"first": fakeCLIPackage{name: "first"},
+		},
+	}
+	var modes []rzpmPkg.LockMode
+	initSite = func(_ string, opts rzpmPkg.SiteOptions) (rzpmPkg.ManagedSite, error) {
+		modes = append(modes, opts.LockMode)
+		return site, nil
+	}
+
+	require.NoError(t, infoPackage(newCLIContext(t, []string{"first"}, false)))
+	require.NoError(t, installPackages(newCLIContext(t, []string{"first"}, false)))
+	assert.Equal(t, []rzpmPkg.LockMode{rzpmPkg.LockShared, rzpmPkg.LockExclusive}, modes, "only commands modifying the site should need exclusive access")
+}
+
+func TestRebuildOutdatedPackages(t *testing.T) {
+	originalInitSite := initSite
+	defer func() { initSite = originalInitSite }()
+
+	site := &fakeCLISite{
+		packages: map[string]rzpmPkg.Package{
+			"first":  fakeCLIPackage{name: "first"},
+			"broken": fakeCLIPackage{name: "broken"},
+		},
+		toRebuild: []rzpmPkg.InstalledPackage{{InstalledName: "first"}, {InstalledName: "broken"}},
+	}
+	initSite = func(string, rzpmPkg.SiteOptions) (rzpmPkg.ManagedSite, error) {
+		return site, nil
+	}
+
+	flagSet := flag.NewFlagSet("rz-pm-test", flag.ContinueOnError)
+	flagSet.Bool("outdated", false, "")
+	require.NoError(t, flagSet.Parse([]string{"--outdated"}))
+	err := rebuildPackages(cli.NewContext(cli.NewApp(), flagSet, nil))
+	assert.ErrorContains(t, err, "1 packages failed to rebuild")
+	assert.Equal(t, []string{"first", "broken"}, site.rebuildCalls, "a failure should not stop the other rebuilds")
+}
+
+func TestExportPackagesToFile(t *testing.T) {
+	originalInitSite := initSite
+	defer func() { initSite = originalInitSite }()
+
+	site := &fakeCLISite{}
+	initSite = func(string, rzpmPkg.SiteOptions) (rzpmPkg.ManagedSite, error) {
+		return site, nil
+	}
+
+	output := filepath.Join(t.TempDir(), "rzpm.lock")
+	flagSet := flag.NewFlagSet("rz-pm-test", flag.ContinueOnError)
+	flagSet.String("output", "", "")
+	require.NoError(t, flagSet.Parse([]string{"--output", output}))
+	require.NoError(t, exportPackages(cli.NewContext(cli.NewApp(), flagSet, nil)))
+
+	lf, err := rzpmPkg.ReadLockfile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "0.8.1", lf.RizinVersion)
+	assert.Equal(t, 1, site.closeCalls)
+}
+
+func TestUpgradePackages(t *testing.T) {
+	originalInitSite := initSite
+	defer func() { initSite = originalInitSite }()
+
+	site := &fakeCLISite{
+		packages: map[string]rzpmPkg.Package{
+			"old":     fakeCLIPackage{name: "old"},
+			"current": fakeCLIPackage{name: "current"},
+		},
+		installed: map[string]bool{"old": true, "current": true},
+		outdated: []rzpmPkg.OutdatedPackage{{
+			Installed: rzpmPkg.InstalledPackage{InstalledName: "old", InstalledVersion: "0.0.0"},
+			Available: fakeCLIPackage{name: "old"},
+		}},
+	}
+	initSite = func(string, rzpmPkg.SiteOptions) (rzpmPkg.ManagedSite, error) {
+		return site, nil
+	}
+
+	require.NoError(t, upgradePackages(newCLIContext(t, []string{}, false)))
+	assert.Equal(t, []string{"old"}, site.upgradeCalls, "all outdated packages should be upgraded")
+
+	site.upgradeCalls = nil
+	require.NoError(t, upgradePackages(newCLIContext(t, []string{"current"}, false)))
+	assert.Empty(t, site.upgradeCalls, "up to date packages should be left alone")
+}
+
+func TestExecDoesNotUpdateDatabase(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("runs true")
+	}
+	originalInitSite := initSite
+	defer func() { initSite = originalInitSite }()
+	t.Setenv(rzpmPkg.EnvNameEnvVar, "")
+
+	var updateDB []bool
+	initSite = func(_ string, opts rzpmPkg.SiteOptions) (rzpmPkg.ManagedSite, error) {
+		updateDB = append(updateDB, opts.UpdateDB)
+		return &fakeCLISite{}, nil
+	}
+
+	require.NoError(t, execInEnv(newCLIContext(t, []string{"true"}, false)))
+	assert.Equal(t, []bool{false}, updateDB, "running a command should not update the database")
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `'/tmp/envs/work'`, shellQuote("/tmp/envs/work"))
+	assert.Equal(t, `'/tmp/it'\''s'`, shellQuote("/tmp/it's"))
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "12 B", formatSize(12))
+	assert.Equal(t, "1.5 KiB", formatSize(1536))
+	assert.Equal(t, "2.0 MiB", formatSize(2*1024*1024))
 }
@@ -0,0 +1,272 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	CredentialsFileEnvVar = "RZPM_CREDENTIALS"
+)
+
+// HostCredentials are the secrets used to access the repositories and
+// archives hosted on Host.
+type HostCredentials struct {
+	Host     string `yaml:"host"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Token is used as password over HTTP(S), for git and archives
+	Token string `yaml:"token"`
+	// BearerToken is sent as "Authorization: Bearer" for archive downloads
+	BearerToken      string `yaml:"bearer_token"`
+	SSHKey           string `yaml:"ssh_key"`
+	SSHKeyPassphrase string `yaml:"ssh_key_passphrase"`
+	// AllowHTTP lets the secrets above be sent over plain HTTP, where
+	// anyone on the network can read them
+	AllowHTTP bool `yaml:"allow_http"`
+}
+
+// checkSecureScheme refuses to send the secrets of host over plain HTTP,
+// unless allowed in the credentials file
+func (host *HostCredentials) checkSecureScheme(scheme string, hostname string) error {
+	if scheme != "http" || host.AllowHTTP {
+		return nil
+	}
+	return fmt.Errorf("refusing to send the credentials of %s over plain HTTP, use HTTPS or set allow_http in %s", hostname, CredentialsFile())
+}
+
+// basicAuth returns the user and password to use over HTTP(S), with the
+// token taking the place of the password
+func (host *HostCredentials) basicAuth() (string, string) {
+	if host.Token == "" {
+		return host.Username, host.Password
+	}
+	if host.Username == "" {
+		// most git hosts accept any non-empty user name with tokens
+		return "rz-pm", host.Token
+	}
+	return host.Username, host.Token
+}
+
+type Credentials struct {
+	// GitCredentialHelper enables `git credential fill` for HTTP(S) git
+	// repositories without credentials in this file
+	GitCredentialHelper bool              `yaml:"git_credential_helper"`
+	Hosts               []HostCredentials `yaml:"hosts"`
+}
+
+func CredentialsFile() string {
+	if envVar := os.Getenv(CredentialsFileEnvVar); envVar != "" {
+		return envVar
+	}
+
+	return filepath.Join(xdg.ConfigHome, "rz-pm", "credentials.yaml")
+}
+
+func loadCredentials() (Credentials, error) {
+	path := CredentialsFile()
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Credentials{}, nil
+	} else if err != nil {
+		return Credentials{}, err
+	}
+
+	var c Credentials
+	err = yaml.Unmarshal(content, &c)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("could not parse credentials file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// forHost returns the credentials of host, which may include a port
+func (c Credentials) forHost(host string) *HostCredentials {
+	hostname := host
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		hostname = h
+	}
+	for i := range c.Hosts {
+		if strings.EqualFold(c.Hosts[i].Host, host) {
+			return &c.Hosts[i]
+		}
+	}
+	for i := range c.Hosts {
+		if strings.EqualFold(c.Hosts[i].Host, hostname) {
+			return &c.Hosts[i]
+		}
+	}
+	return nil
+}
+
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return filepath.Join(xdg.Home, rest)
+	}
+	return path
+}
+
+// redactURL removes any password or token embedded in a URL, so that it can
+// be safely printed in logs.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// gitCredentialFill asks the git credential helpers for the credentials of
+// an HTTP(S) endpoint, without ever prompting the user.
+func gitCredentialFill(e *transport.Endpoint) (*githttp.BasicAuth, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git credential helpers require 'git' in PATH")
+	}
+
+	input := fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n\n", e.Protocol, e.Host, strings.TrimPrefix(e.Path, "/"))
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "SSH_ASKPASS=")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git credential fill failed for %s: %w", e.Host, err)
+	}
+
+	auth := &githttp.BasicAuth{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "username":
+			auth.Username = value
+		case "password":
+			auth.Password = value
+		}
+	}
+	if auth.Password == "" {
+		return nil, nil
+	}
+	return auth, nil
+}
+
+// gitAuth returns the authentication method to use with the git repository
+// at rawURL, or nil to access it anonymously (or with the SSH agent, which
+// is the go-git default for SSH endpoints).
+func gitAuth(rawURL string) (transport.AuthMethod, error) {
+	e, err := transport.NewEndpoint(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	hostPort := e.Host
+	if e.Port != 0 {
+		hostPort = fmt.Sprintf("%s:%d", e.Host, e.Port)
+	}
+	host := creds.forHost(hostPort)
+
+	switch e.Protocol {
+	case "ssh":
+		user := e.User
+		if user == "" {
+			user = "git"
+		}
+		if host != nil && host.SSHKey != "" {
+			log.Printf("Using SSH key %s for %s\n", host.SSHKey, e.Host)
+			return ssh.NewPublicKeysFromFile(user, expandHome(host.SSHKey), host.SSHKeyPassphrase)
+		}
+		// go-git falls back to the SSH agent when no auth is given
+		log.Printf("Using SSH agent for %s\n", e.Host)
+		return nil, nil
+	case "http", "https":
+		if e.Password != "" {
+			// credentials embedded in the URL are used by go-git directly
+			return nil, nil
+		}
+		if host != nil && (host.Token != "" || host.Password != "") {
+			if err := host.checkSecureScheme(e.Protocol, e.Host); err != nil {
+				return nil, err
+			}
+			log.Printf("Using credentials file for %s\n", e.Host)
+			username, password := host.basicAuth()
+			return &githttp.BasicAuth{Username: username, Password: password}, nil
+		}
+		if creds.GitCredentialHelper {
+			auth, err := gitCredentialFill(e)
+			if err != nil {
+				log.Printf("%v\n", err)
+				return nil, nil
+			}
+			if auth != nil {
+				if host == nil {
+					host = &HostCredentials{Host: hostPort}
+				}
+				if err := host.checkSecureScheme(e.Protocol, e.Host); err != nil {
+					return nil, err
+				}
+				log.Printf("Using git credential helper for %s\n", e.Host)
+				return auth, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// checkAuthRedirect is the CheckRedirect of the clients sending credentials:
+// net/http keeps them on redirects to the same host, so redirects from
+// HTTPS to plain HTTP are refused for requests carrying them.
+func checkAuthRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if req.Header.Get("Authorization") != "" && req.URL.Scheme == "http" && via[0].URL.Scheme != "http" {
+		return fmt.Errorf("refusing to send the credentials of %s over plain HTTP, %s redirects to %s", via[0].URL.Host, redactURL(via[0].URL.String()), redactURL(req.URL.String()))
+	}
+	return nil
+}
+
+// setHTTPAuth adds the credentials configured for the host of req, if any.
+// Bearer tokens take precedence over tokens, which take precedence over
+// user and password.
+func setHTTPAuth(req *http.Request) error {
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+
+	host := creds.forHost(req.URL.Host)
+	if host == nil || (host.BearerToken == "" && host.Token == "" && host.Username == "" && host.Password == "") {
+		return nil
+	}
+	if err := host.checkSecureScheme(req.URL.Scheme, req.URL.Host); err != nil {
+		return err
+	}
+	if host.BearerToken != "" {
+		log.Printf("Using bearer token for %s\n", req.URL.Host)
+		req.Header.Set("Authorization", "Bearer "+host.BearerToken)
+	} else {
+		log.Printf("Using credentials file for %s\n", req.URL.Host)
+		req.SetBasicAuth(host.basicAuth())
+	}
+	return nil
+}
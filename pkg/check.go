@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// PluginStatus tells whether rizin could load a plugin installed by a
+// package. Error is what rizin printed about it, if anything.
+type PluginStatus struct {
+	Path   string `json:"path"`
+	Loaded bool   `json:"loaded"`
+	Error  string `json:"error,omitempty"`
+}
+
+type PluginCheck struct {
+	Package string         `json:"package"`
+	Plugins []PluginStatus `json:"plugins"`
+	Broken  bool           `json:"broken"`
+}
+
+func sharedLibraryExt() string {
+	switch runtime.GOOS {
+	case "windows":
+		return ".dll"
+	case "darwin":
+		return ".dylib"
+	default:
+		return ".so"
+	}
+}
+
+// pluginsDir is where the site installs the plugins loaded by rizin
+func (s *RizinSite) pluginsDir() string {
+	return filepath.Join(s.GetPrefix(), userPluginsSubdir(s.rizinPath))
+}
+
+// installedPlugins returns the shared libraries, among files, installed
+// directly in pluginsDir, which rizin loads at startup
+func installedPlugins(pluginsDir string, files []string) []string {
+	plugins := []string{}
+	for _, f := range files {
+		if filepath.Dir(f) == filepath.Clean(pluginsDir) && filepath.Ext(f) == sharedLibraryExt() {
+			plugins = append(plugins, f)
+		}
+	}
+	return plugins
+}
+
+// loadPlugin runs rizin non-interactively to load the plugin library at
+// path. Plugins are not loaded automatically, so that whatever rizin prints
+// on its standard error, which is returned, is about that library.
+func (s *RizinSite) loadPlugin(path string) (string, error) {
+	quoted := `"` + strings.ReplaceAll(path, `"`, `\"`) + `"`
+	cmd := exec.Command(s.rizinPath, "-NN", "-q", "-c", "L "+quoted, "malloc://512")
+	cmd.Env = append(os.Environ(), EnvVars(s, os.Getenv(EnvNameEnvVar))...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return strings.TrimSpace(stderr.String()), err
+}
+
+// checkPlugins checks that rizin loads the plugins among the files installed
+// by the package called name. A plugin is loaded when rizin succeeds without
+// printing any error about it.
+func (s *RizinSite) checkPlugins(name string, files []string) (PluginCheck, error) {
+	check := PluginCheck{Package: name, Plugins: []PluginStatus{}}
+	for _, p := range installedPlugins(s.pluginsDir(), files) {
+		stderr, err := s.loadPlugin(p)
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			return check, fmt.Errorf("could not run rizin to load its plugins: %w", err)
+		}
+		status := PluginStatus{Path: p, Loaded: err == nil && stderr == ""}
+		if !status.Loaded {
+			check.Broken = true
+			status.Error = stderr
+			if status.Error == "" {
+				status.Error = fmt.Sprintf("rizin failed: %v", exitErr)
+			}
+		}
+		check.Plugins = append(check.Plugins, status)
+	}
+	return check, nil
+}
+
+// checkInstalledPlugins is run after installing the files of a package and
+// reports whether its plugins are broken, warning about them
+func (s *RizinSite) checkInstalledPlugins(name string, files []string) bool {
+	check, err := s.checkPlugins(name, files)
+	if err != nil {
+		warnf("could not check that the plugins of %s load: %v", name, err)
+		return false
+	}
+	for _, p := range check.Plugins {
+		if !p.Loaded {
+			warnf("rizin does not load %s of package %s", p.Path, name)
+			if p.Error != "" {
+				fmt.Printf("%s\n", p.Error)
+			}
+		}
+	}
+	return check.Broken
+}
+
+// CheckPackages checks that rizin loads the plugins of the named installed
+// packages, or of all of them when names is empty, and marks the packages
+// whose plugins fail to load as broken.
+func (s *RizinSite) CheckPackages(names []string) ([]PluginCheck, error) {
+	if err := s.checkExclusive(); err != nil {
+		return nil, err
+	}
+	packages := s.installedPackages
+	if len(names) > 0 {
+		packages = []InstalledPackage{}
+		for _, name := range names {
+			p, err := s.GetInstalledPackage(name)
+			if err != nil {
+				return nil, err
+			}
+			packages = append(packages, p)
+		}
+	}
+
+	results := []PluginCheck{}
+	changed := false
+	for _, p := range packages {
+		if p.Disabled {
+			// rizin is not supposed to load them
+			results = append(results, PluginCheck{Package: p.Name(), Plugins: []PluginStatus{}})
+			continue
+		}
+		check, err := s.checkPlugins(p.Name(), p.files())
+		if err != nil {
+			return nil, err
+		}
+		if check.Broken != p.Broken {
+			p.Broken = check.Broken
+			s.replaceInstalledPackage(p)
+			changed = true
+		}
+		results = append(results, check)
+	}
+
+	if changed {
+		installedFilePath := filepath.Join(s.Path, installedFile)
+		if err := updateInstalledPackages(installedFilePath, s.installedPackages); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
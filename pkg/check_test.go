@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPlugins(t *testing.T) {
+	site := newTestSite(t)
+
+	pluginsDir := filepath.Join(site.GetPrefix(), defaultUserPluginsDir)
+	good := filesPackage{FakePackage{myName: "good"}, []string{
+		filepath.Join(pluginsDir, "good"+sharedLibraryExt()),
+		filepath.Join(site.GetPrefix(), "share", "good", "data.sdb"),
+	}}
+	broken := filesPackage{FakePackage{myName: "broken"}, []string{filepath.Join(pluginsDir, "broken"+sharedLibraryExt())}}
+	require.NoError(t, site.InstallPackage(good, InstallOptions{}))
+	require.NoError(t, site.InstallPackage(broken, InstallOptions{}), "broken plugins should not fail the installation")
+
+	installed, err := site.GetInstalledPackage("broken")
+	require.NoError(t, err)
+	assert.True(t, installed.Broken, "the post-install check should mark broken packages")
+	installed, err = site.GetInstalledPackage("good")
+	require.NoError(t, err)
+	assert.False(t, installed.Broken)
+
+	results, err := site.CheckPackages([]string{"good", "broken"})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.False(t, results[0].Broken)
+	assert.Equal(t, []PluginStatus{{Path: good.files[0], Loaded: true}}, results[0].Plugins, "only plugins should be checked")
+	assert.True(t, results[1].Broken)
+	assert.Contains(t, results[1].Plugins[0].Error, "undefined symbol")
+}
+
+func TestCheckPluginsWithRizin(t *testing.T) {
+	rizin, err := exec.LookPath("rizin")
+	if err != nil {
+		t.Skip("rizin is not installed")
+	}
+	site, err := InitSiteWithOptions(t.TempDir(), SiteOptions{Rizin: rizin, Prefix: PrefixSite})
+	require.NoError(t, err)
+	defer site.Close()
+	rs := site.(*RizinSite)
+
+	broken := filepath.Join(rs.pluginsDir(), "broken"+sharedLibraryExt())
+	require.NoError(t, os.MkdirAll(filepath.Dir(broken), 0755))
+	require.NoError(t, os.WriteFile(broken, []byte("not a shared library"), 0644))
+	check, err := rs.checkPlugins("broken", []string{broken})
+	require.NoError(t, err)
+	assert.True(t, check.Broken, "rizin should fail to load a file that is not a plugin")
+	assert.NotEmpty(t, check.Plugins[0].Error)
+
+	// the plugins shipped with rizin, if any, load
+	libDir, err := getRizinVariable(rizin, "RZ_LIBDIR")
+	require.NoError(t, err)
+	shipped, _ := filepath.Glob(filepath.Join(libDir, "rizin", "plugins", "*"+sharedLibraryExt()))
+	if len(shipped) == 0 {
+		t.Skip("rizin has no plugins to load")
+	}
+	stderr, err := rs.loadPlugin(shipped[0])
+	assert.NoError(t, err)
+	assert.Empty(t, stderr)
+}
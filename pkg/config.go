@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrg/xdg"
+)
+
+const configFile string = "config.json"
+
+const (
+	// PrefixHome installs packages in ~/.local, the default
+	PrefixHome = "home"
+	// PrefixSite installs packages in the prefix directory of the site
+	PrefixSite = "site"
+	// PrefixSystem installs packages for every user of the machine
+	PrefixSystem = "system"
+)
+
+const sitePrefixDir string = "prefix"
+
+// SiteConfig holds the properties of a site, chosen when the site is created.
+type SiteConfig struct {
+	// Prefix is the absolute install prefix used to build packages
+	Prefix string `json:"prefix"`
+	// Rizin is the absolute path of the rizin binary the site is used with
+	Rizin string `json:"rizin,omitempty"`
+	// Database is the database directory when it is shared with another
+	// site, e.g. by environments, the one inside the site otherwise
+	Database string `json:"database,omitempty"`
+}
+
+// resolvePrefix returns the absolute install prefix described by spec, which
+// is either one of PrefixHome, PrefixSite, PrefixSystem or an absolute path.
+// PrefixSystem is the prefix the rizin binary at rizin was installed in.
+func resolvePrefix(spec string, sitePath string, rizin string) (string, error) {
+	switch spec {
+	case "", PrefixHome:
+		return filepath.Join(xdg.Home, ".local"), nil
+	case PrefixSite:
+		p, err := filepath.Abs(filepath.Join(sitePath, sitePrefixDir))
+		if err != nil {
+			return "", err
+		}
+		return p, nil
+	case PrefixSystem:
+		if rizin == "" {
+			return "", fmt.Errorf("the system-wide prefix is the one of rizin, which could not be found")
+		}
+		p, err := getRizinVariable(rizin, "RZ_PREFIX")
+		if err != nil {
+			return "", fmt.Errorf("could not get the install prefix of %s: %w", rizin, err)
+		}
+		if !filepath.IsAbs(p) {
+			return "", fmt.Errorf("%s has no absolute install prefix, use an absolute path", rizin)
+		}
+		return filepath.Clean(p), nil
+	}
+
+	if !filepath.IsAbs(spec) {
+		return "", fmt.Errorf("install prefix must be %s, %s, %s or an absolute path, not %s", PrefixHome, PrefixSite, PrefixSystem, spec)
+	}
+	return filepath.Clean(spec), nil
+}
+
+// loadSiteConfig reads the configuration of the site at path, creating it
+// with the prefix and database directory of opts if the site does not have
+// one yet. A new site is bound to rizin, the rizin binary in use. Sites
+// created by older versions of rz-pm, which have installed packages but no
+// configuration, always use PrefixHome and are not bound to any rizin. The
+// configuration of a new site is only written with exclusive access.
+func loadSiteConfig(path string, opts SiteOptions, rizin string) (SiteConfig, error) {
+	prefix := opts.Prefix
+	configPath := filepath.Join(path, configFile)
+	raw, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return SiteConfig{}, err
+	}
+
+	if err == nil {
+		var config SiteConfig
+		err = json.Unmarshal(raw, &config)
+		if err != nil {
+			return SiteConfig{}, fmt.Errorf("could not read site configuration %s: %w", configPath, err)
+		}
+		if prefix != "" {
+			resolved, err := resolvePrefix(prefix, path, rizin)
+			if err != nil {
+				return SiteConfig{}, err
+			}
+			if resolved != config.Prefix {
+				return SiteConfig{}, fmt.Errorf("site %s already uses the install prefix %s, the prefix can only be chosen when the site is created", path, config.Prefix)
+			}
+		}
+		return config, nil
+	}
+
+	resolved, err := resolvePrefix(prefix, path, rizin)
+	if err != nil {
+		return SiteConfig{}, err
+	}
+	config := SiteConfig{Prefix: resolved, Rizin: rizin, Database: opts.DatabaseDir}
+	if _, err := os.Stat(filepath.Join(path, installedFile)); err == nil {
+		// the packages of older sites were installed in ~/.local, for
+		// whatever rizin was in use at the time
+		home, _ := resolvePrefix(PrefixHome, path, rizin)
+		if resolved != home {
+			return SiteConfig{}, fmt.Errorf("site %s was created by an older rz-pm and uses the install prefix %s, the prefix can only be chosen when the site is created", path, home)
+		}
+		config.Rizin = ""
+	}
+	if opts.LockMode == LockExclusive {
+		if err := saveSiteConfig(path, config); err != nil {
+			return SiteConfig{}, err
+		}
+	}
+	return config, nil
+}
+
+// siteDatabaseDir returns the database directory used by the site at path
+func siteDatabaseDir(path string) string {
+	if config, err := readSiteConfig(path); err == nil && config.Database != "" {
+		return config.Database
+	}
+	return filepath.Join(path, dbDir)
+}
+
+func saveSiteConfig(path string, config SiteConfig) error {
+	by, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(path, configFile), by, 0644, false)
+}
+
+// isWithinDir reports whether path is dir or is inside it, without following
+// symbolic links.
+func isWithinDir(dir string, path string) bool {
+	if dir == "" || !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) && !filepath.IsAbs(rel)
+}
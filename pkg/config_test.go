@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/adrg/xdg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSiteConfig(t *testing.T) {
+	sitePath := t.TempDir()
+
+	config, err := loadSiteConfig(sitePath, SiteOptions{Prefix: PrefixSite}, "")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(sitePath, sitePrefixDir), config.Prefix)
+
+	config, err = loadSiteConfig(sitePath, SiteOptions{}, "")
+	require.NoError(t, err, "an existing site keeps its prefix")
+	assert.Equal(t, filepath.Join(sitePath, sitePrefixDir), config.Prefix)
+
+	_, err = loadSiteConfig(sitePath, SiteOptions{Prefix: PrefixHome}, "")
+	assert.ErrorContains(t, err, "can only be chosen when the site is created")
+
+	newSitePath := t.TempDir()
+	config, err = loadSiteConfig(newSitePath, SiteOptions{LockMode: LockShared}, "")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(xdg.Home, ".local"), config.Prefix, "sites use ~/.local by default")
+	assert.NoFileExists(t, filepath.Join(newSitePath, configFile), "the configuration is only saved when asked")
+}
+
+func TestLoadSiteConfigOlderSite(t *testing.T) {
+	sitePath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(sitePath, installedFile), []byte("[]"), 0644))
+
+	_, err := loadSiteConfig(sitePath, SiteOptions{Prefix: PrefixSite}, "")
+	assert.ErrorContains(t, err, "was created by an older rz-pm")
+	assert.NoFileExists(t, filepath.Join(sitePath, configFile))
+
+	config, err := loadSiteConfig(sitePath, SiteOptions{Prefix: PrefixHome}, "")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(xdg.Home, ".local"), config.Prefix)
+	config, err = readSiteConfig(sitePath)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(xdg.Home, ".local"), config.Prefix, "the prefix of older sites is recorded")
+}
+
+func TestResolvePrefix(t *testing.T) {
+	_, err := resolvePrefix("relative/path", t.TempDir(), "")
+	assert.Error(t, err)
+
+	_, err = resolvePrefix(PrefixSystem, t.TempDir(), "")
+	assert.Error(t, err, "the system prefix needs rizin")
+
+	if runtime.GOOS != "windows" {
+		rizinDir := t.TempDir()
+		prefix, err := resolvePrefix(PrefixSystem, t.TempDir(), writeFakeRizin(t, rizinDir, "0.8.0"))
+		require.NoError(t, err)
+		assert.Equal(t, rizinDir, prefix, "the system prefix is the one of rizin")
+
+		prefix, err = resolvePrefix("/opt/rizin/", t.TempDir(), "")
+		require.NoError(t, err)
+		assert.Equal(t, "/opt/rizin", prefix)
+	}
+}
+
+func TestIsWithinDir(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "prefix")
+	assert.True(t, isWithinDir(prefix, filepath.Join(prefix, "lib", "libplugin.so")))
+	assert.True(t, isWithinDir(prefix, prefix))
+	assert.False(t, isWithinDir(prefix, filepath.Join(prefix, "..", "other", "file")))
+	assert.False(t, isWithinDir(prefix, prefix+"X"))
+	assert.False(t, isWithinDir(prefix, "lib/libplugin.so"))
+	assert.False(t, isWithinDir("", filepath.Join(prefix, "file")))
+}
@@ -3,39 +3,139 @@ package pkg
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hashicorp/go-version"
 	"gopkg.in/yaml.v2"
 )
 
 type Database struct {
 	Path string
+	// updated is true when the database HEAD moved during InitDatabase
+	updated bool
+}
+
+// PackageChange describes a package that changed between two versions of
+// the database. OldVersion is empty for added packages and NewVersion is
+// empty for removed ones.
+type PackageChange struct {
+	Name       string `json:"name"`
+	OldVersion string `json:"old_version,omitempty"`
+	NewVersion string `json:"new_version,omitempty"`
+}
+
+// DatabaseChanges lists the packages that changed with the last update of
+// the database, i.e. between the commits From and To.
+type DatabaseChanges struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Added   []PackageChange `json:"added"`
+	Removed []PackageChange `json:"removed"`
+	Bumped  []PackageChange `json:"bumped"`
+	// Updated is true when the changes were pulled by this rz-pm run
+	Updated bool `json:"-"`
 }
 
 var ErrRizinPackageWrongHash = errors.New("wrong hash")
 
 const dbPath string = "db"
 
+const remoteBranchPrefix string = "refs/remotes/origin/"
+
+// databaseFetchDepth limits the history downloaded for every database branch
+const databaseFetchDepth = 1
+
+// databaseSparseDirs are the only directories of the database checked out,
+// the rest of the repository is not needed by rz-pm
+var databaseSparseDirs = []string{dbPath}
+
+// previousHeadRef points to the database commit checked out before the last
+// update that changed it
+const previousHeadRef plumbing.ReferenceName = "refs/rz-pm/previous"
+
 func InitDatabase(path string, rizinVersion string, updateDB bool) (Database, error) {
-	d := Database{path}
+	d := Database{Path: path}
 
 	if updateDB {
-		err := d.updateDatabase(rizinVersion)
+		updated, err := d.lockedUpdateDatabase(rizinVersion)
 		if err != nil {
-			return Database{}, fmt.Errorf("could not download the rz-pm database")
+			return Database{}, fmt.Errorf("could not download the rz-pm database: %w", err)
 		}
+		d.updated = updated
+	}
+	if warning := d.branchWarning(rizinVersion); warning != "" {
+		warnf("%s", warning)
 	}
 
 	return d, nil
 }
 
+// lockedUpdateDatabase updates the database holding its lock, which is
+// separate from the site lock so that instances only reading the site can
+// update it too. When another instance is already updating the database, it
+// waits for it to finish and skips the update.
+func (d Database) lockedUpdateDatabase(rizinVersion string) (bool, error) {
+	lock := newDatabaseLock(d.Path)
+	err := lock.Lock()
+	if errors.Is(err, ErrSiteLocked) {
+		log.Printf("The rz-pm database is being updated by another instance, not updating it\n")
+		if err := lock.LockWait(); err != nil {
+			return false, err
+		}
+		return false, lock.Unlock()
+	} else if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+	return d.updateDatabase(rizinVersion)
+}
+
+// branchWarning returns a warning when the checked out rz-pm-db branch is not
+// one made for the major.minor version of rizin, telling why it is used: a
+// fallback to master or to a major-only branch, an override with --db-branch
+// or a database not updated since rizin changed.
+func (d Database) branchWarning(rizinVersion string) string {
+	repo, err := git.PlainOpen(d.Path)
+	if err != nil {
+		return ""
+	}
+	head, err := repo.Head()
+	if err != nil || !head.Name().IsBranch() {
+		return ""
+	}
+	name := head.Name().Short()
+	branches, err := listDatabaseBranches(repo)
+	if err != nil {
+		return ""
+	}
+
+	var reason string
+	branch, why, err := selectDatabaseBranch(branches, rizinVersion)
+	switch {
+	case err == nil && branch.name == name:
+		if branch.segments != 1 {
+			return ""
+		}
+		reason = why
+	case RZPM_DB_BRANCH == name:
+		reason = "requested with --db-branch"
+	case err != nil && name == plumbing.Master.Short():
+		reason = err.Error()
+	default:
+		reason = fmt.Sprintf("it was not updated for rizin %s", rizinVersion)
+	}
+	return fmt.Sprintf("using rz-pm-db branch %s: %s", name, reason)
+}
+
 func getBranchName(s string) plumbing.ReferenceName {
 	return plumbing.ReferenceName("refs/remotes/origin/v" + s)
 }
@@ -51,107 +151,387 @@ func remoteBranches(s storer.ReferenceStorer) (storer.ReferenceIter, error) {
 	}, refs), nil
 }
 
-func (d Database) switchTag(repo *git.Repository, w *git.Worktree, rizinVersion string) (string, error) {
-	branches, err := remoteBranches(repo.Storer)
+// databaseBranch is a branch of the rz-pm-db repository. Branches named after
+// a rizin version (e.g. v0.8 or v0.8.1) carry the parsed version.
+type databaseBranch struct {
+	name     string
+	hash     plumbing.Hash
+	version  *version.Version
+	segments int
+}
+
+func newDatabaseBranch(name string, hash plumbing.Hash) databaseBranch {
+	b := databaseBranch{name: name, hash: hash}
+	if !strings.HasPrefix(name, "v") {
+		return b
+	}
+
+	v, err := version.NewVersion(strings.TrimPrefix(name, "v"))
+	if err != nil || v.Prerelease() != "" || v.Metadata() != "" {
+		return b
+	}
+	b.version = v
+	b.segments = len(strings.Split(strings.TrimPrefix(name, "v"), "."))
+	return b
+}
+
+// selectDatabaseBranch picks the branch that is closest to rizinVersion among
+// the compatible ones and returns a human readable reason for the choice. A
+// branch is compatible when it has the same major version and, if specified,
+// the same minor version as rizin. Patch-level branches are compatible only
+// with rizin releases that are not older than them.
+func selectDatabaseBranch(branches []databaseBranch, rizinVersion string) (databaseBranch, string, error) {
+	rv, err := version.NewVersion(rizinVersion)
 	if err != nil {
-		return "", err
+		return databaseBranch{}, "", fmt.Errorf("could not parse rizin version %s: %w", rizinVersion, err)
+	}
+	rs := rv.Segments()
+
+	const (
+		prioExact = iota
+		prioMinor
+		prioPatch
+		prioMajor
+		prioNone
+	)
+
+	var best databaseBranch
+	bestPrio := prioNone
+	for _, b := range branches {
+		if b.version == nil {
+			continue
+		}
+		bs := b.version.Segments()
+		if bs[0] != rs[0] {
+			continue
+		}
+
+		var prio int
+		switch b.segments {
+		case 1:
+			prio = prioMajor
+		case 2:
+			if bs[1] != rs[1] {
+				continue
+			}
+			prio = prioMinor
+		case 3:
+			if bs[1] != rs[1] || bs[2] > rs[2] {
+				continue
+			}
+			if bs[2] == rs[2] {
+				prio = prioExact
+			} else {
+				prio = prioPatch
+			}
+		default:
+			continue
+		}
+
+		if prio < bestPrio || (prio == bestPrio && b.version.GreaterThan(best.version)) {
+			best = b
+			bestPrio = prio
+		}
 	}
 
-	versionPieces := strings.SplitN(rizinVersion, ".", 3)
+	switch bestPrio {
+	case prioExact:
+		return best, fmt.Sprintf("exact match for rizin %s", rizinVersion), nil
+	case prioMinor:
+		return best, fmt.Sprintf("matches rizin %d.%d.x", rs[0], rs[1]), nil
+	case prioPatch:
+		return best, fmt.Sprintf("closest older patch release for rizin %s", rizinVersion), nil
+	case prioMajor:
+		return best, fmt.Sprintf("only branch matching rizin major version %d", rs[0]), nil
+	}
+	return databaseBranch{}, "", fmt.Errorf("no rz-pm-db branch is compatible with rizin %s", rizinVersion)
+}
 
-	var switchBranch string
-	var switchHash plumbing.Hash
-	var switchBranchPrio int = math.MaxInt
-	_ = branches.ForEach(func(b *plumbing.Reference) error {
-		pieces := strings.Split(b.Name().String(), "/")
-		branchName := pieces[len(pieces)-1]
-		if branchName == "v"+rizinVersion && switchBranchPrio > 0 {
-			switchBranch = branchName
-			switchBranchPrio = 0
-			switchHash = b.Hash()
-		} else if branchName == "v"+versionPieces[0]+"."+versionPieces[1] && switchBranchPrio > 1 {
-			switchBranch = branchName
-			switchBranchPrio = 1
-			switchHash = b.Hash()
-		} else if branchName == "v"+versionPieces[0] && switchBranchPrio > 2 {
-			switchBranch = branchName
-			switchBranchPrio = 2
-			switchHash = b.Hash()
+func listDatabaseBranches(repo *git.Repository) ([]databaseBranch, error) {
+	refs, err := remoteBranches(repo.Storer)
+	if err != nil {
+		return nil, err
+	}
+
+	var branches []databaseBranch
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name, ok := strings.CutPrefix(ref.Name().String(), remoteBranchPrefix)
+		if ok && name != "HEAD" {
+			branches = append(branches, newDatabaseBranch(name, ref.Hash()))
 		}
 		return nil
 	})
+	return branches, err
+}
 
-	if switchBranchPrio == math.MaxInt {
-		return "", fmt.Errorf("could not find a tag for version %s", rizinVersion)
+// switchTag checks out the rz-pm-db branch to be used with rizinVersion,
+// honouring the RZPM_DB_BRANCH override. It returns the selected branch name
+// and the reason it was chosen.
+func (d Database) switchTag(repo *git.Repository, w *git.Worktree, rizinVersion string) (string, string, error) {
+	branches, err := listDatabaseBranches(repo)
+	if err != nil {
+		return "", "", err
 	}
 
-	localBranchName := plumbing.ReferenceName("refs/heads/" + switchBranch)
-	create := false
-	if _, err := repo.Storer.Reference(localBranchName); err != nil {
-		ref := plumbing.NewHashReference(localBranchName, switchHash)
-		err = repo.Storer.SetReference(ref)
+	var branch databaseBranch
+	var reason string
+	if RZPM_DB_BRANCH != "" {
+		found := false
+		for _, b := range branches {
+			if b.name == RZPM_DB_BRANCH {
+				branch, found = b, true
+				break
+			}
+		}
+		if !found {
+			return "", "", fmt.Errorf("rz-pm-db branch %s does not exist", RZPM_DB_BRANCH)
+		}
+		reason = "requested with --db-branch"
+	} else {
+		branch, reason, err = selectDatabaseBranch(branches, rizinVersion)
 		if err != nil {
-			return "", err
+			master, ok := findDatabaseBranch(branches, plumbing.Master.Short())
+			if !ok {
+				return "", "", err
+			}
+			branch, reason = master, err.Error()
 		}
-		create = true
 	}
 
-	err = w.Checkout(&git.CheckoutOptions{Branch: localBranchName, Create: create})
+	switched, err := checkoutDatabaseBranch(repo, w, branch)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	return switchBranch, nil
+	if switched {
+		log.Printf("Switched rz-pm-db to %s (%s)\n", branch.name, reason)
+	}
+	return branch.name, reason, nil
+}
+
+func findDatabaseBranch(branches []databaseBranch, name string) (databaseBranch, bool) {
+	for _, b := range branches {
+		if b.name == name {
+			return b, true
+		}
+	}
+	return databaseBranch{}, false
+}
+
+// checkoutDatabaseBranch moves the worktree to the tip of the remote branch.
+// Local branches always follow their remote counterpart, as the database
+// never has local commits. It reports whether the checked out branch changed.
+func checkoutDatabaseBranch(repo *git.Repository, w *git.Worktree, branch databaseBranch) (bool, error) {
+	localBranchName := plumbing.NewBranchReferenceName(branch.name)
+	h, err := repo.Head()
+	if err == nil && h.Name() == localBranchName {
+		if h.Hash() == branch.hash {
+			return false, nil
+		}
+		return false, w.ResetSparsely(&git.ResetOptions{Commit: branch.hash, Mode: git.HardReset}, databaseSparseDirs)
+	}
+
+	err = repo.Storer.SetReference(plumbing.NewHashReference(localBranchName, branch.hash))
+	if err != nil {
+		return false, err
+	}
+	return true, w.Checkout(&git.CheckoutOptions{
+		Branch:                    localBranchName,
+		Force:                     true,
+		SparseCheckoutDirectories: databaseSparseDirs,
+	})
 }
 
-func (d Database) updateDatabase(rizinVersion string) error {
+// updateDatabase downloads or refreshes the database with shallow fetches of
+// every branch, then checks out the db directory of the branch matching
+// rizinVersion. It reports
+// whether the checked out commit changed.
+func (d Database) updateDatabase(rizinVersion string) (bool, error) {
+	auth, err := gitAuth(RZPM_DB_REPO_URL)
+	if err != nil {
+		return false, err
+	}
+
+	var previousHead plumbing.Hash
+	cloned := false
 	repo, err := git.PlainOpen(d.Path)
 	if err == git.ErrRepositoryNotExists {
-		log.Printf("Downloading rz-pm-db repository...\n")
-		repo, err = git.PlainClone(d.Path, false, &git.CloneOptions{
-			URL: RZPM_DB_REPO_URL,
+		cloned = true
+		err = runWithDotProgressTo(os.Stderr, "Downloading rz-pm database...", gitProgressDotInterval, func() error {
+			var err error
+			repo, err = git.PlainClone(d.Path, false, &git.CloneOptions{
+				URL:        RZPM_DB_REPO_URL,
+				Auth:       auth,
+				Depth:      databaseFetchDepth,
+				NoCheckout: true,
+			})
+			return err
+		})
+	} else if err == nil {
+		if h, err := repo.Head(); err == nil {
+			previousHead = h.Hash()
+		}
+		err = runWithDotProgressTo(os.Stderr, "Updating rz-pm database...", gitProgressDotInterval, func() error {
+			err := repo.Fetch(&git.FetchOptions{
+				RemoteName: "origin",
+				Auth:       auth,
+				Depth:      databaseFetchDepth,
+				Force:      true,
+				Prune:      true,
+			})
+			if err == git.NoErrAlreadyUpToDate {
+				return nil
+			}
+			return err
 		})
 	}
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	w, err := repo.Worktree()
 	if err != nil {
-		return err
+		return false, err
+	}
+	if cloned {
+		// the clone checks out nothing, only the db directory is needed
+		h, err := repo.Head()
+		if err != nil {
+			return false, err
+		}
+		err = w.ResetSparsely(&git.ResetOptions{Commit: h.Hash(), Mode: git.HardReset}, databaseSparseDirs)
+		if err != nil {
+			return false, err
+		}
 	}
-	log.Printf("Updating rz-pm-db repository...\n")
-	err = w.Pull(&git.PullOptions{RemoteName: "origin"})
-	//below branch selction logic should also be used for a sucessfull pull, for a non-default branch
-	if err != nil && err != git.NoErrAlreadyUpToDate {
-		return err
+
+	branchName, reason, err := d.switchTag(repo, w, rizinVersion)
+	if err != nil {
+		return false, err
 	}
+	log.Printf("Using rz-pm-db branch %s (%s)\n", branchName, reason)
 
 	h, err := repo.Head()
 	if err != nil {
-		return err
+		return false, err
+	}
+	if previousHead.IsZero() || previousHead == h.Hash() {
+		return false, nil
 	}
 
-	branchName := h.Name().String()
-	branchNamePieces := strings.Split(branchName, "/")
-	branchName = strings.TrimLeft(branchNamePieces[len(branchNamePieces)-1], "v")
+	log.Printf("rz-pm-db updated from %s to %s\n", previousHead, h.Hash())
+	err = repo.Storer.SetReference(plumbing.NewHashReference(previousHeadRef, previousHead))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	if !strings.HasPrefix(rizinVersion, branchName) {
-		tagName, err := d.switchTag(repo, w, rizinVersion)
+// packageVersionsAt returns the name and version of the packages defined by
+// the given database files, indexed by their path in the repository
+func packageVersionsAt(files map[string]*object.File) map[string]string {
+	versions := map[string]string{}
+	for path, f := range files {
+		if f == nil || !strings.HasPrefix(path, dbPath+"/") {
+			continue
+		}
+		content, err := f.Contents()
 		if err != nil {
-			log.Printf("Failed to switch rz-pm-db to version %s, default to main branch", rizinVersion)
-			err = w.Checkout(&git.CheckoutOptions{Branch: "refs/heads/master"})
-			if err != nil {
-				return err
-			}
-		} else {
-			log.Printf("Switched rz-pm-db to %s...\n", tagName)
+			continue
+		}
+		var p RizinPackage
+		if err := yaml.Unmarshal([]byte(content), &p); err != nil || p.PackageName == "" {
+			continue
+		}
+		versions[p.PackageName] = p.PackageVersion
+	}
+	return versions
+}
+
+// Changes returns the packages added, removed or changed in version by the
+// last update of the database.
+func (d Database) Changes() (DatabaseChanges, error) {
+	repo, err := git.PlainOpen(d.Path)
+	if err != nil {
+		return DatabaseChanges{}, err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return DatabaseChanges{}, err
+	}
+	previous, err := repo.Reference(previousHeadRef, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return DatabaseChanges{From: head.Hash().String(), To: head.Hash().String()}, nil
+	} else if err != nil {
+		return DatabaseChanges{}, err
+	}
+
+	treeAt := func(h plumbing.Hash) (*object.Tree, error) {
+		commit, err := repo.CommitObject(h)
+		if err != nil {
+			return nil, fmt.Errorf("could not read rz-pm-db commit %s: %w", h, err)
+		}
+		return commit.Tree()
+	}
+	fromTree, err := treeAt(previous.Hash())
+	if err != nil {
+		return DatabaseChanges{}, err
+	}
+	toTree, err := treeAt(head.Hash())
+	if err != nil {
+		return DatabaseChanges{}, err
+	}
+
+	diff, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return DatabaseChanges{}, err
+	}
+	fromFiles := map[string]*object.File{}
+	toFiles := map[string]*object.File{}
+	for _, change := range diff {
+		from, to, err := change.Files()
+		if err != nil {
+			return DatabaseChanges{}, err
+		}
+		fromFiles[change.From.Name] = from
+		toFiles[change.To.Name] = to
+	}
+	oldVersions := packageVersionsAt(fromFiles)
+	newVersions := packageVersionsAt(toFiles)
+
+	changes := DatabaseChanges{
+		From:    previous.Hash().String(),
+		To:      head.Hash().String(),
+		Added:   []PackageChange{},
+		Removed: []PackageChange{},
+		Bumped:  []PackageChange{},
+		Updated: d.updated,
+	}
+	for name, newVersion := range newVersions {
+		oldVersion, ok := oldVersions[name]
+		if !ok {
+			changes.Added = append(changes.Added, PackageChange{Name: name, NewVersion: newVersion})
+		} else if oldVersion != newVersion {
+			changes.Bumped = append(changes.Bumped, PackageChange{Name: name, OldVersion: oldVersion, NewVersion: newVersion})
+		}
+	}
+	for name, oldVersion := range oldVersions {
+		if _, ok := newVersions[name]; !ok {
+			changes.Removed = append(changes.Removed, PackageChange{Name: name, OldVersion: oldVersion})
 		}
 	}
 
-	return nil
+	for _, l := range [][]PackageChange{changes.Added, changes.Removed, changes.Bumped} {
+		sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	}
+	return changes, nil
 }
 
 func ParsePackageFile(path string) (Package, error) {
+	return parseRizinPackageFile(path)
+}
+
+func parseRizinPackageFile(path string) (RizinPackage, error) {
 	content, err := os.ReadFile(path)
 	if err != nil {
 		return RizinPackage{}, err
@@ -181,29 +561,56 @@ func ParsePackageFile(path string) (Package, error) {
 	return p, nil
 }
 
+// ListAvailablePackages returns every package of the database. Packages can
+// be grouped in nested directories (e.g. db/arch/), in which case the
+// category of a package is its directory relative to db/.
 func (d Database) ListAvailablePackages() ([]Package, error) {
 	dbPath := filepath.Join(d.Path, dbPath)
-	files, err := os.ReadDir(dbPath)
-	if err != nil {
+	if _, err := os.Stat(dbPath); err != nil {
 		return nil, err
 	}
 
 	packages := []Package{}
-	for _, file := range files {
-		// skip directories
+	seen := map[string]string{}
+	err := filepath.WalkDir(dbPath, func(name string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip hidden files and directories
+		if name != dbPath && strings.HasPrefix(file.Name(), ".") {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if file.IsDir() {
-			continue
+			return nil
 		}
 
-		name := filepath.Join(dbPath, file.Name())
+		p, err := parseRizinPackageFile(name)
+		if err != nil {
+			warnf("could not read %s: %v", name, err)
+			return nil
+		}
 
-		p, err := ParsePackageFile(name)
+		if other, ok := seen[p.PackageName]; ok {
+			return fmt.Errorf("package %s is defined both in %s and %s", p.PackageName, other, name)
+		}
+		seen[p.PackageName] = name
+
+		category, err := filepath.Rel(dbPath, filepath.Dir(name))
 		if err != nil {
-			fmt.Printf("Warning: could not read %s: %v\n", name, err)
-			continue
+			return err
+		}
+		if category != "." {
+			p.PackageCategory = filepath.ToSlash(category)
 		}
 
 		packages = append(packages, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return packages, nil
@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDatabaseBranches(names ...string) []databaseBranch {
+	branches := []databaseBranch{}
+	for _, name := range names {
+		branches = append(branches, newDatabaseBranch(name, plumbing.ZeroHash))
+	}
+	return branches
+}
+
+func TestSelectDatabaseBranch(t *testing.T) {
+	tests := []struct {
+		rizinVersion string
+		branches     []string
+		want         string
+	}{
+		{"0.8.1", []string{"master", "v0.8", "v0.8.1", "v0"}, "v0.8.1"},
+		{"0.8.1", []string{"master", "v0.8", "v0"}, "v0.8"},
+		{"0.8.2", []string{"master", "v0.8.0", "v0.8.1", "v0.8.3"}, "v0.8.1"},
+		{"0.8.1", []string{"master", "v0.7", "v0"}, "v0"},
+		{"0.10.0", []string{"master", "v0.1", "v0.10"}, "v0.10"},
+		{"0.1.2", []string{"master", "v0.10", "v0.1"}, "v0.1"},
+		{"0.9.0-git", []string{"master", "v0.9", "v0.8"}, "v0.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rizinVersion, func(t *testing.T) {
+			branch, reason, err := selectDatabaseBranch(newTestDatabaseBranches(tt.branches...), tt.rizinVersion)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, branch.name)
+			assert.NotEmpty(t, reason, "the choice of the branch should be explained")
+		})
+	}
+}
+
+func TestSelectDatabaseBranchNoCompatibleBranch(t *testing.T) {
+	_, _, err := selectDatabaseBranch(newTestDatabaseBranches("master", "v0.1", "v1.0", "vfoo"), "0.10.0")
+	assert.Error(t, err, "v0.1 must not be considered compatible with rizin 0.10.0")
+}
+
+func writeTestPackageFile(t *testing.T, path string, name string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	content := fmt.Sprintf(`name: %s
+version: 0.0.1
+summary: %s summary
+source:
+  url: https://example.com/%s.git
+  build_system: meson
+`, name, name, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestListAvailablePackagesCategories(t *testing.T) {
+	tmpPath := t.TempDir()
+	writeTestPackageFile(t, filepath.Join(tmpPath, "db", "toplevel"), "toplevel")
+	writeTestPackageFile(t, filepath.Join(tmpPath, "db", "arch", "myarch"), "myarch")
+	writeTestPackageFile(t, filepath.Join(tmpPath, "db", "bin", "elf", "myelf"), "myelf")
+	writeTestPackageFile(t, filepath.Join(tmpPath, "db", ".hidden", "hidden"), "hidden")
+
+	d := Database{Path: tmpPath}
+	packages, err := d.ListAvailablePackages()
+	require.NoError(t, err)
+	require.Len(t, packages, 3)
+
+	categories := map[string]string{}
+	for _, p := range packages {
+		categories[p.Name()] = p.Category()
+	}
+	assert.Equal(t, map[string]string{
+		"toplevel": "",
+		"myarch":   "arch",
+		"myelf":    "bin/elf",
+	}, categories)
+
+	p, err := d.GetPackage("myelf")
+	require.NoError(t, err)
+	assert.Equal(t, "bin/elf", p.Category())
+}
+
+func TestListAvailablePackagesDuplicateNames(t *testing.T) {
+	tmpPath := t.TempDir()
+	writeTestPackageFile(t, filepath.Join(tmpPath, "db", "arch", "dup"), "dup")
+	writeTestPackageFile(t, filepath.Join(tmpPath, "db", "bin", "dup"), "dup")
+
+	d := Database{Path: tmpPath}
+	_, err := d.ListAvailablePackages()
+	assert.ErrorContains(t, err, "package dup is defined both in")
+}
+
+func commitTestDatabase(t *testing.T, repo *git.Repository, message string) {
+	t.Helper()
+
+	w, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, w.AddWithOptions(&git.AddOptions{All: true}))
+	_, err = w.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: "rz-pm test", Email: "test@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+}
+
+func TestDatabaseChanges(t *testing.T) {
+	srcPath := t.TempDir()
+	repo, err := git.PlainInit(srcPath, false)
+	require.NoError(t, err)
+	writeTestPackageFile(t, filepath.Join(srcPath, "db", "kept"), "kept")
+	writeTestPackageFile(t, filepath.Join(srcPath, "db", "removed"), "removed")
+	writeTestPackageFile(t, filepath.Join(srcPath, "db", "bumped"), "bumped")
+	commitTestDatabase(t, repo, "initial database")
+
+	originalURL := RZPM_DB_REPO_URL
+	defer func() { RZPM_DB_REPO_URL = originalURL }()
+	RZPM_DB_REPO_URL = srcPath
+
+	dbPath := filepath.Join(t.TempDir(), "rz-pm-db")
+	d, err := InitDatabase(dbPath, "0.8.0", true)
+	require.NoError(t, err)
+	changes, err := d.Changes()
+	require.NoError(t, err)
+	assert.False(t, changes.Updated, "a fresh clone has no previous version to compare to")
+	assert.Empty(t, changes.Added)
+
+	require.NoError(t, os.Remove(filepath.Join(srcPath, "db", "removed")))
+	writeTestPackageFile(t, filepath.Join(srcPath, "db", "arch", "added"), "added")
+	bumped := filepath.Join(srcPath, "db", "bumped")
+	content, err := os.ReadFile(bumped)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(bumped, []byte(strings.Replace(string(content), "0.0.1", "0.0.2", 1)), 0644))
+	commitTestDatabase(t, repo, "update database")
+
+	d, err = InitDatabase(dbPath, "0.8.0", true)
+	require.NoError(t, err)
+	changes, err = d.Changes()
+	require.NoError(t, err)
+	assert.True(t, changes.Updated)
+	assert.Equal(t, []PackageChange{{Name: "added", NewVersion: "0.0.1"}}, changes.Added)
+	assert.Equal(t, []PackageChange{{Name: "removed", OldVersion: "0.0.1"}}, changes.Removed)
+	assert.Equal(t, []PackageChange{{Name: "bumped", OldVersion: "0.0.1", NewVersion: "0.0.2"}}, changes.Bumped)
+
+	// the changes are kept until the next update that changes the database
+	d, err = InitDatabase(dbPath, "0.8.0", true)
+	require.NoError(t, err)
+	changes, err = d.Changes()
+	require.NoError(t, err)
+	assert.False(t, changes.Updated)
+	assert.Len(t, changes.Added, 1)
+}
+
+func TestUpdateDatabaseShallowFetchesNewBranches(t *testing.T) {
+	srcPath := t.TempDir()
+	repo, err := git.PlainInit(srcPath, false)
+	require.NoError(t, err)
+	writeTestPackageFile(t, filepath.Join(srcPath, "db", "first"), "first")
+	commitTestDatabase(t, repo, "first commit")
+	writeTestPackageFile(t, filepath.Join(srcPath, "db", "second"), "second")
+	require.NoError(t, os.WriteFile(filepath.Join(srcPath, "README.md"), []byte("rz-pm-db"), 0644))
+	commitTestDatabase(t, repo, "second commit")
+
+	originalURL := RZPM_DB_REPO_URL
+	defer func() { RZPM_DB_REPO_URL = originalURL }()
+	RZPM_DB_REPO_URL = srcPath
+
+	dbPath := filepath.Join(t.TempDir(), "rz-pm-db")
+	_, err = InitDatabase(dbPath, "0.8.0", true)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dbPath, ".git", "shallow"))
+	assert.NoError(t, err, "the database should be cloned with a limited depth")
+	assert.FileExists(t, filepath.Join(dbPath, "db", "second"))
+	assert.NoFileExists(t, filepath.Join(dbPath, "README.md"), "only the db directory should be checked out")
+	d := Database{Path: dbPath}
+	assert.Contains(t, d.branchWarning("0.8.0"), "using rz-pm-db branch master: no rz-pm-db branch is compatible")
+	assert.NotEmpty(t, d.branchWarning("0.8.0"), "the fallback branch should be reported on every run")
+
+	// a branch for the current rizin version is published after the first clone
+	head, err := repo.Head()
+	require.NoError(t, err)
+	require.NoError(t, repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("v0.8"), head.Hash())))
+
+	_, err = InitDatabase(dbPath, "0.8.0", true)
+	require.NoError(t, err)
+	clone, err := git.PlainOpen(dbPath)
+	require.NoError(t, err)
+	cloneHead, err := clone.Head()
+	require.NoError(t, err)
+	assert.Equal(t, plumbing.NewBranchReferenceName("v0.8"), cloneHead.Name())
+	assert.FileExists(t, filepath.Join(dbPath, "db", "second"))
+	assert.NoFileExists(t, filepath.Join(dbPath, "README.md"), "switching branches should keep the checkout sparse")
+	assert.Empty(t, d.branchWarning("0.8.0"), "the branch of the rizin major.minor version is the usual one")
+	assert.Empty(t, d.branchWarning("0.8"))
+	assert.Contains(t, d.branchWarning("0.9.0"), "using rz-pm-db branch v0.8: it was not updated for rizin 0.9.0")
+
+	originalBranch := RZPM_DB_BRANCH
+	defer func() { RZPM_DB_BRANCH = originalBranch }()
+	RZPM_DB_BRANCH = "v0.8"
+	assert.Empty(t, d.branchWarning("0.8.1"), "requesting the usual branch is not a warning")
+	assert.Contains(t, d.branchWarning("0.9.0"), "using rz-pm-db branch v0.8: requested with --db-branch")
+	RZPM_DB_BRANCH = originalBranch
+
+	// only a major-only branch matches rizin
+	require.NoError(t, repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("v0"), head.Hash())))
+	_, err = InitDatabase(dbPath, "0.9.0", true)
+	require.NoError(t, err)
+	assert.Contains(t, d.branchWarning("0.9.0"), "using rz-pm-db branch v0: only branch matching rizin major version 0")
+}
+
+func TestUpdateDatabaseWaitsForOtherUpdates(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), dbDir)
+	lock := newDatabaseLock(dbPath)
+	require.NoError(t, lock.Lock())
+	go func() {
+		time.Sleep(2 * lockPollInterval)
+		lock.Unlock()
+	}()
+
+	// the database is not a repository, updating it would fail
+	updated, err := Database{Path: dbPath}.lockedUpdateDatabase("0.8.1")
+	require.NoError(t, err, "the update is skipped while another instance updates the database")
+	assert.False(t, updated)
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(dbPath), databaseLockFileName))
+}
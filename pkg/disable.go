@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// disabledDir holds the plugins of the disabled packages, in a directory per
+// package mirroring their path in the install prefix
+const disabledDir string = "disabled"
+
+// disabledPath returns where the plugin at path of the package called name
+// is kept while the package is disabled
+func (s *RizinSite) disabledPath(name string, path string) (string, error) {
+	rel, err := filepath.Rel(s.GetPrefix(), path)
+	if err != nil || !isWithinDir(s.GetPrefix(), path) {
+		return "", fmt.Errorf("%s is outside of the install prefix %s", path, s.GetPrefix())
+	}
+	return filepath.Join(s.Path, disabledDir, name, rel), nil
+}
+
+// moveFile renames src to dst, copying it when they are on different
+// filesystems
+func moveFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(src, dst, fi.Mode().Perm()); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// movePlugins moves the plugins of ip from where rizin loads them to the
+// holding area of the site when disable is set, and back otherwise. Plugins
+// already moved are restored when a move fails.
+func (s *RizinSite) movePlugins(ip InstalledPackage, disable bool) error {
+	moved := [][2]string{}
+	for _, plugin := range installedPlugins(s.pluginsDir(), ip.files()) {
+		held, err := s.disabledPath(ip.Name(), plugin)
+		if err != nil {
+			return err
+		}
+		src, dst := held, plugin
+		if disable {
+			src, dst = plugin, held
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			err = fmt.Errorf("%s already exists", dst)
+		} else {
+			err = moveFile(src, dst)
+		}
+		if err != nil {
+			for i := len(moved) - 1; i >= 0; i-- {
+				if err := moveFile(moved[i][1], moved[i][0]); err != nil {
+					warnf("could not move %s back to %s: %v", moved[i][1], moved[i][0], err)
+				}
+			}
+			return err
+		}
+		moved = append(moved, [2]string{src, dst})
+	}
+	return nil
+}
+
+func (s *RizinSite) setDisabled(name string, disable bool) error {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	ip, err := s.GetInstalledPackage(name)
+	if err != nil {
+		return fmt.Errorf("package %s not installed", name)
+	}
+	if ip.Disabled == disable {
+		if disable {
+			return fmt.Errorf("package %s is already disabled", name)
+		}
+		return fmt.Errorf("package %s is not disabled", name)
+	}
+	if len(installedPlugins(s.pluginsDir(), ip.files())) == 0 {
+		return fmt.Errorf("package %s has no plugin in %s to disable", name, s.pluginsDir())
+	}
+
+	if err := s.movePlugins(ip, disable); err != nil {
+		return fmt.Errorf("could not move the plugins of %s: %w", name, err)
+	}
+	if !disable {
+		s.dropDisabledPlugins(name)
+	}
+
+	ip.Disabled = disable
+	s.replaceInstalledPackage(ip)
+	installedFilePath := filepath.Join(s.Path, installedFile)
+	return updateInstalledPackages(installedFilePath, s.installedPackages)
+}
+
+// DisablePackage stops rizin from loading the plugins of the named package,
+// moving them to the site, without uninstalling it
+func (s *RizinSite) DisablePackage(name string) error {
+	return s.setDisabled(name, true)
+}
+
+// EnablePackage moves back the plugins of a package disabled with
+// DisablePackage
+func (s *RizinSite) EnablePackage(name string) error {
+	return s.setDisabled(name, false)
+}
+
+// dropDisabledPlugins removes the plugins kept for the package called name,
+// which are stale once the package is enabled, reinstalled or uninstalled
+func (s *RizinSite) dropDisabledPlugins(name string) {
+	dir := filepath.Join(s.Path, disabledDir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		warnf("could not remove %s: %v", dir, err)
+	}
+}
+
+// heldPlugins maps the plugins of ip, if it is disabled, to where they are
+// kept
+func (s *RizinSite) heldPlugins(ip InstalledPackage) map[string]string {
+	held := map[string]string{}
+	if !ip.Disabled {
+		return held
+	}
+	for _, plugin := range installedPlugins(s.pluginsDir(), ip.files()) {
+		if p, err := s.disabledPath(ip.Name(), plugin); err == nil {
+			held[plugin] = p
+		}
+	}
+	return held
+}
+
+// withDisabledPaths returns ip with the recorded plugin files pointing to
+// where they are kept, if the package is disabled
+func (s *RizinSite) withDisabledPaths(ip InstalledPackage) InstalledPackage {
+	held := s.heldPlugins(ip)
+	if len(held) == 0 {
+		return ip
+	}
+
+	files := []string{}
+	for _, f := range ip.files() {
+		if p, ok := held[f]; ok {
+			f = p
+		}
+		files = append(files, f)
+	}
+	fileInfo := make([]InstalledFile, len(ip.FileInfo))
+	for i, f := range ip.FileInfo {
+		if p, ok := held[f.Path]; ok {
+			f.Path = p
+		}
+		fileInfo[i] = f
+	}
+	ip.InstalledFiles = &files
+	ip.FileInfo = fileInfo
+	return ip
+}
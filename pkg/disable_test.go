@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisablePackage(t *testing.T) {
+	site := newTestSite(t)
+
+	plugin := filepath.Join(site.GetPrefix(), defaultUserPluginsDir, "x"+sharedLibraryExt())
+	data := filepath.Join(site.GetPrefix(), "share", "x", "data.sdb")
+	p := filesPackage{FakePackage{myName: "x"}, []string{plugin, data}}
+	require.NoError(t, site.InstallPackage(p, InstallOptions{}))
+
+	require.NoError(t, site.DisablePackage("x"))
+	held := filepath.Join(site.Path, disabledDir, "x", defaultUserPluginsDir, "x"+sharedLibraryExt())
+	assert.NoFileExists(t, plugin, "rizin should not find the plugin anymore")
+	assert.FileExists(t, held)
+	assert.FileExists(t, data, "only plugins should be moved")
+	installed, err := site.GetInstalledPackage("x")
+	require.NoError(t, err)
+	assert.True(t, installed.Disabled)
+
+	report, err := site.VerifyPackages([]string{"x"})
+	require.NoError(t, err)
+	require.Len(t, report.Packages, 1)
+	assert.Empty(t, report.Packages[0].Problems, "the plugins of disabled packages are not missing")
+
+	assert.Error(t, site.DisablePackage("x"))
+	assert.Error(t, site.DisablePackage("not-installed"))
+
+	usage, err := site.DiskUsage()
+	require.NoError(t, err)
+	require.Len(t, usage, 1)
+	assert.Equal(t, int64(2), usage[0].Installed, "the plugins held by the site should be counted")
+
+	require.NoError(t, site.EnablePackage("x"))
+	assert.FileExists(t, plugin)
+	assert.NoDirExists(t, filepath.Join(site.Path, disabledDir, "x"))
+	installed, err = site.GetInstalledPackage("x")
+	require.NoError(t, err)
+	assert.False(t, installed.Disabled)
+	assert.Error(t, site.EnablePackage("x"))
+}
+
+func TestDisablePackageWithoutPlugins(t *testing.T) {
+	site := newTestSite(t)
+
+	data := filepath.Join(site.GetPrefix(), "share", "x", "data.sdb")
+	require.NoError(t, site.InstallPackage(filesPackage{FakePackage{myName: "x"}, []string{data}}, InstallOptions{}))
+
+	assert.ErrorContains(t, site.DisablePackage("x"), "has no plugin")
+	installed, err := site.GetInstalledPackage("x")
+	require.NoError(t, err)
+	assert.False(t, installed.Disabled)
+}
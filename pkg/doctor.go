@@ -0,0 +1,322 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+type CheckStatus string
+
+const (
+	CheckOK      CheckStatus = "ok"
+	CheckWarning CheckStatus = "warning"
+	CheckError   CheckStatus = "error"
+)
+
+// networkTimeout limits how long the network check waits for the database
+const networkTimeout = 10 * time.Second
+
+// DoctorCheck is the result of one of the checks run by Diagnose. Fix tells
+// how to solve the problem, when Status is not CheckOK.
+type DoctorCheck struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+	Fix    string      `json:"fix,omitempty"`
+}
+
+type doctor struct {
+	checks []DoctorCheck
+}
+
+func (d *doctor) ok(name string, format string, args ...interface{}) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: CheckOK, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) warn(name string, detail string, fix string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: CheckWarning, Detail: detail, Fix: fix})
+}
+
+func (d *doctor) fail(name string, detail string, fix string) {
+	d.checks = append(d.checks, DoctorCheck{Name: name, Status: CheckError, Detail: detail, Fix: fix})
+}
+
+// Diagnose checks everything rz-pm needs to build and install packages in
+// the site at path, without opening or locking it.
+func Diagnose(path string, opts SiteOptions) []DoctorCheck {
+	d := &doctor{}
+
+	config, configErr := readSiteConfig(path)
+	rizin, err := findRizin(opts.Rizin)
+	if err != nil {
+		d.fail("rizin", err.Error(), "install rizin and make sure it is in PATH, or select it with --rizin")
+	} else if configErr == nil && config.Rizin != "" && config.Rizin != rizin {
+		if opts.PerRizinSite {
+			path = PerRizinSiteDir(path, rizin)
+			config, configErr = readSiteConfig(path)
+			if opts.Prefix == "" {
+				opts.Prefix = PrefixSite
+			}
+		} else {
+			d.fail("rizin", fmt.Sprintf("the site was created for %s but %s is selected", config.Rizin, rizin),
+				fmt.Sprintf("select it with --rizin %s, or use --per-rizin-site", config.Rizin))
+		}
+	}
+	if rizin != "" {
+		d.checkRizin(rizin)
+	}
+	d.checkBuildTools()
+	if rizin != "" {
+		d.checkPkgConfig(rizin)
+	}
+
+	prefix := ""
+	if configErr == nil {
+		prefix = config.Prefix
+	} else if prefix, err = resolvePrefix(opts.Prefix, path, rizin); err != nil {
+		d.fail("prefix", err.Error(), "select a valid prefix with --prefix")
+	}
+	if prefix != "" {
+		d.checkWritable("prefix", prefix, "choose a writable prefix with --prefix when creating the site, or fix the permissions")
+		pluginsDir := defaultUserPluginsDir
+		if rizin != "" {
+			pluginsDir = userPluginsSubdir(rizin)
+		}
+		d.checkWritable("plugin directory", filepath.Join(prefix, pluginsDir), "fix the permissions of the plugin directory")
+	}
+
+	d.checkLock(path)
+	d.checkDatabase(siteDatabaseDir(path))
+	d.checkNetwork(RZPM_DB_REPO_URL)
+	return d.checks
+}
+
+// readSiteConfig reads the configuration of the site at path, without
+// creating it
+func readSiteConfig(path string) (SiteConfig, error) {
+	raw, err := os.ReadFile(filepath.Join(path, configFile))
+	if err != nil {
+		return SiteConfig{}, err
+	}
+	var config SiteConfig
+	err = json.Unmarshal(raw, &config)
+	return config, err
+}
+
+func (d *doctor) checkRizin(rizin string) {
+	version, err := getRizinVersion(rizin)
+	if err != nil || version == "" {
+		d.fail("rizin", fmt.Sprintf("%s -H RZ_VERSION failed: %v", rizin, err), "reinstall rizin, or select a working one with --rizin")
+		return
+	}
+	d.ok("rizin", "%s, version %s", rizin, version)
+
+	libDir, err := getRizinLibPath(rizin)
+	if err != nil || libDir == "" {
+		d.fail("RZ_LIBDIR", fmt.Sprintf("%s -H RZ_LIBDIR failed: %v", rizin, err), "reinstall rizin")
+		return
+	}
+	if _, err := os.Stat(libDir); err != nil {
+		d.fail("RZ_LIBDIR", fmt.Sprintf("%s does not exist", libDir), "reinstall rizin, its libraries are missing")
+		return
+	}
+	d.ok("RZ_LIBDIR", "%s", libDir)
+
+	devFix := "install the rizin development files (e.g. librizin-dev, rizin-devel, etc.)"
+	if dir, err := getPkgConfigPath(rizin); err != nil || dir == "" {
+		d.fail("pkg-config directory", fmt.Sprintf("no pkgconfig directory in %s", libDir), devFix)
+	} else {
+		d.ok("pkg-config directory", "%s", dir)
+	}
+	if dir, err := getCMakePath(rizin); err != nil || dir == "" {
+		d.warn("cmake directory", fmt.Sprintf("no cmake directory in %s, cmake packages cannot be built", libDir), devFix)
+	} else {
+		d.ok("cmake directory", "%s", dir)
+	}
+}
+
+// toolVersion returns the first line printed by name --version
+func toolVersion(name string) (string, string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return path, "", err
+	}
+	return path, strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]), nil
+}
+
+func (d *doctor) checkBuildTools() {
+	tools := []struct {
+		name     string
+		required bool
+		fix      string
+	}{
+		{"meson", true, "install meson (e.g. pip install meson) and make sure it is in PATH"},
+		{"ninja", true, "install ninja (e.g. pip install ninja) and make sure it is in PATH"},
+		{"cmake", false, "install cmake to build packages using it"},
+	}
+	for _, tool := range tools {
+		path, version, err := toolVersion(tool.name)
+		switch {
+		case err != nil && tool.required:
+			d.fail(tool.name, fmt.Sprintf("%s not found: %v", tool.name, err), tool.fix)
+		case err != nil:
+			d.warn(tool.name, fmt.Sprintf("%s not found: %v", tool.name, err), tool.fix)
+		default:
+			d.ok(tool.name, "%s (%s)", version, path)
+		}
+	}
+
+	compilers := []string{"cc", "gcc", "clang"}
+	if cc := os.Getenv("CC"); cc != "" {
+		compilers = []string{cc}
+	} else if runtime.GOOS == "windows" {
+		compilers = []string{"cl", "gcc", "clang"}
+	}
+	for _, cc := range compilers {
+		if path, err := exec.LookPath(cc); err == nil {
+			if _, version, err := toolVersion(cc); err == nil {
+				d.ok("compiler", "%s (%s)", version, path)
+			} else {
+				d.ok("compiler", "%s", path)
+			}
+			return
+		}
+	}
+	d.fail("compiler", fmt.Sprintf("none of %s found", strings.Join(compilers, ", ")), "install a C compiler (e.g. gcc or clang), or point CC to it")
+}
+
+func (d *doctor) checkPkgConfig(rizin string) {
+	if _, err := exec.LookPath("pkg-config"); err != nil {
+		d.fail("pkg-config", "pkg-config not found", "install pkg-config and make sure it is in PATH")
+		return
+	}
+
+	cmd := exec.Command("pkg-config", "--modversion", "rz_core")
+	if dir, err := getPkgConfigPath(rizin); err == nil && dir != "" {
+		cmd.Env = append(os.Environ(), "PKG_CONFIG_PATH="+dir+string(os.PathListSeparator)+os.Getenv("PKG_CONFIG_PATH"))
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		d.fail("rz_core", "rz_core cannot be found through pkg-config", "install the rizin development files, or add the directory holding rz_core.pc to PKG_CONFIG_PATH")
+		return
+	}
+	d.ok("rz_core", "version %s", strings.TrimSpace(string(out)))
+}
+
+// checkWritable checks that files can be created in dir, or in its closest
+// existing parent when it does not exist yet
+func (d *doctor) checkWritable(name string, dir string, fix string) {
+	existing := dir
+	for {
+		if fi, err := os.Stat(existing); err == nil {
+			if !fi.IsDir() {
+				d.fail(name, fmt.Sprintf("%s is not a directory", existing), fix)
+				return
+			}
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			d.fail(name, fmt.Sprintf("no parent of %s exists", dir), fix)
+			return
+		}
+		existing = parent
+	}
+
+	f, err := os.CreateTemp(existing, ".rz-pm-doctor-*")
+	if err != nil {
+		d.fail(name, fmt.Sprintf("%s is not writable: %v", existing, err), fix)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	d.ok(name, "%s", dir)
+}
+
+func (d *doctor) checkLock(path string) {
+	lockPath := filepath.Join(path, lockFileName)
+	if _, err := os.Stat(lockPath); os.IsNotExist(err) {
+		d.ok("site lock", "not locked")
+		return
+	}
+
+	owner, stale := isStaleLock(lockPath)
+	switch {
+	case stale && owner != nil:
+		d.warn("site lock", fmt.Sprintf("stale lock left by %s", owner), "nothing to do, the next rz-pm command breaks it")
+	case stale:
+		d.warn("site lock", "stale lock left by an older rz-pm", "nothing to do, the next rz-pm command breaks it")
+	case owner != nil:
+		d.warn("site lock", fmt.Sprintf("in use by %s", owner), "wait for it to finish, or use --wait")
+	default:
+		d.ok("site lock", "in use by a reader")
+	}
+}
+
+func (d *doctor) checkDatabase(dbPath string) {
+	fix := "run `rz-pm list` to download it"
+	repo, err := git.PlainOpen(dbPath)
+	if err != nil {
+		d.fail("database", fmt.Sprintf("%s is not a git repository: %v", dbPath, err), fix)
+		return
+	}
+	head, err := repo.Head()
+	if err != nil {
+		d.fail("database", fmt.Sprintf("%s has no commit checked out: %v", dbPath, err), "remove "+dbPath+" and "+fix)
+		return
+	}
+	packages, err := Database{Path: dbPath}.ListAvailablePackages()
+	if err != nil {
+		d.fail("database", fmt.Sprintf("could not read the packages: %v", err), "remove "+dbPath+" and "+fix)
+		return
+	}
+	d.ok("database", "%s at %s, %d packages", head.Name().Short(), head.Hash().String()[:12], len(packages))
+}
+
+func (d *doctor) checkNetwork(rawURL string) {
+	fix := "check your network connection and proxy settings, or use a reachable mirror with RZPM_DB_REPO_URL"
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		// local path or scp-like URL, nothing to reach over HTTP
+		d.ok("network", "%s is not an HTTP URL, not checked", redactURL(rawURL))
+		return
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		client := http.Client{Timeout: networkTimeout}
+		resp, err := client.Head(rawURL)
+		if err != nil {
+			d.fail("network", fmt.Sprintf("%s is not reachable: %v", redactURL(rawURL), err), fix)
+			return
+		}
+		resp.Body.Close()
+	default:
+		port := u.Port()
+		if port == "" {
+			port = "22"
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), networkTimeout)
+		if err != nil {
+			d.fail("network", fmt.Sprintf("%s is not reachable: %v", redactURL(rawURL), err), fix)
+			return
+		}
+		conn.Close()
+	}
+	d.ok("network", "%s is reachable", redactURL(rawURL))
+}
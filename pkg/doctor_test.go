@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func findCheck(t *testing.T, checks []DoctorCheck, name string) DoctorCheck {
+	t.Helper()
+	for _, c := range checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("check %s not found", name)
+	return DoctorCheck{}
+}
+
+func TestDiagnose(t *testing.T) {
+	originalURL := RZPM_DB_REPO_URL
+	defer func() { RZPM_DB_REPO_URL = originalURL }()
+	RZPM_DB_REPO_URL = t.TempDir()
+
+	site := newTestSite(t)
+	require.NoError(t, site.Close())
+
+	// a lock left by a process that is gone
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	hostname, _ := os.Hostname()
+	by, err := json.Marshal(lockOwner{PID: cmd.Process.Pid, Hostname: hostname, StartTime: time.Now()})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(site.Path, lockFileName), by, 0644))
+
+	checks := Diagnose(site.Path, SiteOptions{Rizin: site.RizinBinary()})
+	assert.Equal(t, CheckOK, findCheck(t, checks, "rizin").Status)
+	assert.Contains(t, findCheck(t, checks, "rizin").Detail, "0.8.1")
+	assert.Equal(t, CheckOK, findCheck(t, checks, "RZ_LIBDIR").Status)
+	assert.Equal(t, CheckError, findCheck(t, checks, "pkg-config directory").Status, "the fake rizin has no development files")
+	assert.Equal(t, CheckOK, findCheck(t, checks, "prefix").Status)
+	assert.Equal(t, CheckWarning, findCheck(t, checks, "site lock").Status)
+	database := findCheck(t, checks, "database")
+	assert.Equal(t, CheckError, database.Status)
+	assert.NotEmpty(t, database.Fix)
+	assert.Equal(t, CheckOK, findCheck(t, checks, "network").Status, "local databases need no network")
+	for _, c := range checks {
+		if c.Status != CheckOK {
+			assert.NotEmpty(t, c.Fix, "every problem should come with a fix: %s", c.Name)
+		}
+	}
+
+	checks = Diagnose(site.Path, SiteOptions{Rizin: writeFakeRizin(t, t.TempDir(), "0.8.1")})
+	assert.Contains(t, findCheck(t, checks, "rizin").Fix, "--per-rizin-site")
+}
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/adrg/xdg"
+)
+
+const (
+	EnvsDirEnvVar = "RZPM_ENVSDIR"
+	EnvNameEnvVar = "RZPM_ENV"
+)
+
+// defaultUserPluginsDir is where rizin looks for user plugins, relative to
+// the home prefix, when it cannot be asked.
+const defaultUserPluginsDir string = "lib/rizin/plugins"
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// EnvsDir is the directory holding the environments, i.e. separate sites with
+// their own set of installed plugins.
+func EnvsDir() string {
+	if envVar := os.Getenv(EnvsDirEnvVar); envVar != "" {
+		return envVar
+	}
+
+	return filepath.Join(xdg.DataHome, "rz-pm", "envs")
+}
+
+// EnvDir returns the site directory of the environment called name.
+func EnvDir(name string) (string, error) {
+	if !envNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid environment name %q, use letters, digits, '.', '_' and '-'", name)
+	}
+	return filepath.Join(EnvsDir(), name), nil
+}
+
+// ListEnvs returns the names of the existing environments, sorted.
+func ListEnvs() ([]string, error) {
+	entries, err := os.ReadDir(EnvsDir())
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		if e.IsDir() && envNameRegexp.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CreateEnv creates the environment called name. Environments always install
+// packages in their own prefix, inside the environment directory, and share
+// the database of the current site.
+func CreateEnv(name string, opts SiteOptions) (ManagedSite, error) {
+	path, err := EnvDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("environment %s already exists", name)
+	}
+	if opts.Prefix != "" && opts.Prefix != PrefixSite {
+		return nil, fmt.Errorf("environments always use their own install prefix")
+	}
+
+	opts.Prefix = PrefixSite
+	opts.DatabaseDir = siteDatabaseDir(SiteDir())
+	opts.LockMode = LockExclusive
+	return InitSiteWithOptions(path, opts)
+}
+
+// OpenEnv opens the site of the existing environment called name.
+func OpenEnv(name string, opts SiteOptions) (ManagedSite, error) {
+	path, err := EnvDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("environment %s does not exist", name)
+	}
+
+	opts.Prefix = ""
+	return InitSiteWithOptions(path, opts)
+}
+
+// userPluginsSubdir returns where rizin looks for user plugins, relative to
+// the install prefix, so that the same layout can be used in environments.
+func userPluginsSubdir(rizin string) string {
+	dir, err := getRizinVariable(rizin, "RZ_USER_PLUGINS")
+	if err != nil {
+		return defaultUserPluginsDir
+	}
+	rel, err := filepath.Rel(filepath.Join(xdg.Home, ".local"), dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return defaultUserPluginsDir
+	}
+	return rel
+}
+
+// EnvVars returns the environment variables to run rizin with the plugins
+// and data installed in site, as NAME=value strings. name is the name of the
+// environment of site, if any.
+func EnvVars(site Site, name string) []string {
+	vars := []string{
+		SiteDirEnvVar + "=" + site.GetBaseDir(),
+		EnvsDirEnvVar + "=" + EnvsDir(),
+		EnvNameEnvVar + "=" + name,
+	}
+
+	prefix := site.GetPrefix()
+	homePrefix, _ := resolvePrefix(PrefixHome, "", "")
+	if prefix == homePrefix {
+		// rizin already looks there
+		return vars
+	}
+	return append(vars,
+		"RZ_LIBR_PLUGINS="+filepath.Join(prefix, userPluginsSubdir(site.RizinBinary())),
+		"XDG_DATA_HOME="+filepath.Join(prefix, "share"),
+		"PATH="+filepath.Join(prefix, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"),
+	)
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvs(t *testing.T) {
+	envsDir := t.TempDir()
+	t.Setenv(EnvsDirEnvVar, envsDir)
+	siteDir := t.TempDir()
+	t.Setenv(SiteDirEnvVar, siteDir)
+	opts := SiteOptions{Rizin: writeFakeRizin(t, t.TempDir(), "0.8.1")}
+
+	names, err := ListEnvs()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	_, err = CreateEnv("../escape", opts)
+	assert.ErrorContains(t, err, "invalid environment name")
+
+	site, err := CreateEnv("work", opts)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(envsDir, "work"), site.GetBaseDir())
+	assert.Equal(t, filepath.Join(envsDir, "work", sitePrefixDir), site.GetPrefix(), "environments use their own prefix")
+
+	vars := EnvVars(site, "work")
+	assert.Contains(t, vars, SiteDirEnvVar+"="+site.GetBaseDir())
+	assert.Contains(t, vars, EnvNameEnvVar+"=work")
+	assert.Contains(t, vars, "RZ_LIBR_PLUGINS="+filepath.Join(site.GetPrefix(), defaultUserPluginsDir))
+	site.Close()
+	assert.Equal(t, filepath.Join(siteDir, dbDir), siteDatabaseDir(site.GetBaseDir()), "environments share the database of the site")
+	assert.NoDirExists(t, filepath.Join(site.GetBaseDir(), dbDir))
+
+	_, err = CreateEnv("work", opts)
+	assert.ErrorContains(t, err, "already exists")
+	_, err = CreateEnv("other", SiteOptions{Rizin: opts.Rizin, Prefix: PrefixHome})
+	assert.Error(t, err, "environments cannot share the home prefix")
+
+	// with an environment active
+	t.Setenv(SiteDirEnvVar, filepath.Join(envsDir, "work"))
+	site, err = CreateEnv("analysis", opts)
+	require.NoError(t, err)
+	site.Close()
+	assert.Equal(t, filepath.Join(siteDir, dbDir), siteDatabaseDir(site.GetBaseDir()))
+	names, err = ListEnvs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"analysis", "work"}, names)
+
+	site, err = OpenEnv("work", opts)
+	require.NoError(t, err)
+	require.NoError(t, site.Remove())
+	site.Close()
+	assert.DirExists(t, filepath.Join(siteDir, dbDir), "the shared database is kept")
+	_, err = OpenEnv("work", opts)
+	assert.ErrorContains(t, err, "does not exist")
+}
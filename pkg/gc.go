@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ArtifactDir is the directory holding the sources and the build of one
+// version of a package
+type ArtifactDir struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+}
+
+type GCOptions struct {
+	// DryRun only reports what would be removed
+	DryRun bool
+	// KeepInstalled keeps the artifacts of the installed version of each
+	// package, even when the database has a newer one
+	KeepInstalled bool
+}
+
+// PackageUsage is the disk space used by a package, in bytes
+type PackageUsage struct {
+	Package   string `json:"package"`
+	Artifacts int64  `json:"artifacts"`
+	Installed int64  `json:"installed"`
+}
+
+// dirSize returns the size of the files in dir, without following symbolic
+// links
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil && !d.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// listArtifactDirs returns the artifacts of every package version, sorted
+func (s *RizinSite) listArtifactDirs() ([]ArtifactDir, error) {
+	packages, err := os.ReadDir(s.GetArtifactsDir())
+	if os.IsNotExist(err) {
+		return []ArtifactDir{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dirs := []ArtifactDir{}
+	for _, p := range packages {
+		if !p.IsDir() {
+			continue
+		}
+		versions, err := os.ReadDir(filepath.Join(s.GetArtifactsDir(), p.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			if !v.IsDir() {
+				continue
+			}
+			path := filepath.Join(s.GetArtifactsDir(), p.Name(), v.Name())
+			dirs = append(dirs, ArtifactDir{Package: p.Name(), Version: v.Name(), Path: path, Size: dirSize(path)})
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].Package != dirs[j].Package {
+			return dirs[i].Package < dirs[j].Package
+		}
+		return dirs[i].Version < dirs[j].Version
+	})
+	return dirs, nil
+}
+
+// keepArtifacts reports whether the artifacts in dir are still useful: they
+// belong to an installed package and are of its latest version in the
+// database, or of its installed version when opts.KeepInstalled is set.
+// Packages installed by rz-pm v0.1.9 need them to be uninstalled.
+func (s *RizinSite) keepArtifacts(dir ArtifactDir, latest map[string]string, opts GCOptions) bool {
+	installed, err := s.GetInstalledPackage(dir.Package)
+	if err != nil {
+		return false
+	}
+	if installed.InstalledVersion == dir.Version && (opts.KeepInstalled || installed.InstalledFiles == nil) {
+		return true
+	}
+	if v, ok := latest[dir.Package]; ok {
+		return v == dir.Version
+	}
+	// not in the database, the installed version is the latest known
+	return installed.InstalledVersion == dir.Version
+}
+
+// CollectGarbage removes the artifacts of the packages that are not installed
+// and of their old versions, and returns the removed directories.
+func (s *RizinSite) CollectGarbage(opts GCOptions) ([]ArtifactDir, error) {
+	if !opts.DryRun {
+		if err := s.checkExclusive(); err != nil {
+			return nil, err
+		}
+	}
+	dirs, err := s.listArtifactDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[string]string{}
+	if available, err := s.ListAvailablePackages(); err == nil {
+		for _, p := range available {
+			latest[p.Name()] = p.Version()
+		}
+	}
+
+	removed := []ArtifactDir{}
+	for _, dir := range dirs {
+		if s.keepArtifacts(dir, latest, opts) {
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.RemoveAll(dir.Path); err != nil {
+				return removed, err
+			}
+			// only succeeds when no other version is left
+			os.Remove(filepath.Dir(dir.Path))
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+// DiskUsage returns the space used by the artifacts and the installed files
+// of every package, sorted by name.
+func (s *RizinSite) DiskUsage() ([]PackageUsage, error) {
+	dirs, err := s.listArtifactDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]*PackageUsage{}
+	get := func(name string) *PackageUsage {
+		if _, ok := usage[name]; !ok {
+			usage[name] = &PackageUsage{Package: name}
+		}
+		return usage[name]
+	}
+	for _, dir := range dirs {
+		get(dir.Package).Artifacts += dir.Size
+	}
+	for _, p := range s.installedPackages {
+		u := get(p.Name())
+		for _, f := range s.withDisabledPaths(p).files() {
+			if fi, err := os.Lstat(f); err == nil && !fi.IsDir() {
+				u.Installed += fi.Size()
+			}
+		}
+	}
+
+	result := []PackageUsage{}
+	for _, u := range usage {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Package < result[j].Package })
+	return result, nil
+}
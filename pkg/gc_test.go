@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	site := newTestSite(t)
+
+	writeTestDatabasePackage(t, site, "plugin", "name: plugin\nversion: 2.0.0\nsummary: plugin\nsource:\n  url: https://example.com/plugin-2.0.0.tar.gz\n  hash: aaaa\n  build_system: meson\n")
+	for _, dir := range []string{"plugin/1.0.0", "plugin/2.0.0", "plugin/0.9.0", "removed/1.0.0"} {
+		path := filepath.Join(site.GetArtifactsDir(), filepath.FromSlash(dir))
+		require.NoError(t, os.MkdirAll(path, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(path, "source.c"), []byte("int main;"), 0644))
+	}
+	require.NoError(t, site.InstallPackage(versionedPackage{filesPackage{FakePackage{myName: "plugin"}, nil}, "1.0.0"}, InstallOptions{}))
+
+	names := func(dirs []ArtifactDir) []string {
+		n := []string{}
+		for _, d := range dirs {
+			n = append(n, d.Package+"/"+d.Version)
+		}
+		return n
+	}
+
+	removed, err := site.CollectGarbage(GCOptions{DryRun: true, KeepInstalled: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plugin/0.9.0", "removed/1.0.0"}, names(removed))
+	assert.Equal(t, int64(len("int main;")), removed[0].Size)
+	_, err = os.Stat(removed[0].Path)
+	assert.NoError(t, err, "dry runs should not remove anything")
+
+	removed, err = site.CollectGarbage(GCOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plugin/0.9.0", "plugin/1.0.0", "removed/1.0.0"}, names(removed))
+	_, err = os.Stat(filepath.Join(site.GetArtifactsDir(), "removed"))
+	assert.True(t, os.IsNotExist(err), "empty package directories should be removed")
+
+	usage, err := site.DiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, []PackageUsage{{Package: "plugin", Artifacts: int64(len("int main;"))}}, usage)
+}
@@ -0,0 +1,461 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generationsDir holds a manifest per generation of the installed packages,
+// and the archives of the packages they reference in generationsStoreDir,
+// shared between generations
+const generationsDir string = "generations"
+const generationsStoreDir string = "store"
+const currentGenerationFile string = "current"
+
+// keptGenerations is how many generations are kept when a new one is
+// recorded, the oldest ones are deleted
+const keptGenerations = 20
+
+// GenerationPackage is a package installed in a generation, with the archive
+// of its files
+type GenerationPackage struct {
+	InstalledPackage
+	Archive string `json:"archive"`
+}
+
+// Generation is a snapshot of the installed packages, recorded after they
+// change, that SwitchGeneration can go back to
+type Generation struct {
+	ID          int                 `json:"id"`
+	Created     time.Time           `json:"created"`
+	Description string              `json:"description"`
+	Packages    []GenerationPackage `json:"packages"`
+	// Current is set on the generation matching the installed packages
+	Current bool `json:"current,omitempty"`
+}
+
+func (s *RizinSite) generationsPath(elem ...string) string {
+	return filepath.Join(append([]string{s.Path, generationsDir}, elem...)...)
+}
+
+// generationArchive names the archive of ip after its installed state entry,
+// so that identical installations share it
+func generationArchive(ip InstalledPackage) (string, error) {
+	// the archive has the plugins in place
+	ip.Disabled = false
+	by, err := json.Marshal(ip)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(by)
+	return ip.Name() + "-" + hex.EncodeToString(sum[:8]) + ".tar.gz", nil
+}
+
+func (s *RizinSite) readGeneration(id int) (Generation, error) {
+	by, err := os.ReadFile(s.generationsPath(strconv.Itoa(id) + ".json"))
+	if os.IsNotExist(err) {
+		return Generation{}, fmt.Errorf("generation %d does not exist", id)
+	} else if err != nil {
+		return Generation{}, err
+	}
+	var g Generation
+	if err := json.Unmarshal(by, &g); err != nil {
+		return Generation{}, fmt.Errorf("invalid generation %d: %w", id, err)
+	}
+	return g, nil
+}
+
+func (s *RizinSite) currentGeneration() int {
+	by, err := os.ReadFile(s.generationsPath(currentGenerationFile))
+	if err != nil {
+		return 0
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(by)))
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+func (s *RizinSite) setCurrentGeneration(id int) error {
+	return writeFileAtomic(s.generationsPath(currentGenerationFile), []byte(strconv.Itoa(id)+"\n"), 0644, false)
+}
+
+// ListGenerations returns the recorded generations, oldest first
+func (s *RizinSite) ListGenerations() ([]Generation, error) {
+	entries, err := os.ReadDir(s.generationsPath())
+	if os.IsNotExist(err) {
+		return []Generation{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	current := s.currentGeneration()
+	generations := []Generation{}
+	for _, e := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json"))
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" || err != nil {
+			continue
+		}
+		g, err := s.readGeneration(id)
+		if err != nil {
+			return nil, err
+		}
+		g.Current = g.ID == current
+		generations = append(generations, g)
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i].ID < generations[j].ID })
+	return generations, nil
+}
+
+// sameGeneration tells whether the generation has exactly the given
+// packages, with the given archives
+func sameGeneration(g Generation, packages []InstalledPackage, archives map[string]string) bool {
+	if len(g.Packages) != len(packages) {
+		return false
+	}
+	disabled := map[string]bool{}
+	for _, ip := range packages {
+		disabled[ip.Name()] = ip.Disabled
+	}
+	for _, p := range g.Packages {
+		if archives[p.Name()] != p.Archive || disabled[p.Name()] != p.Disabled {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordGeneration records the installed packages as a new generation,
+// unless they did not change since the current one, and prunes the oldest
+// generations beyond the last keptGenerations. It reports whether a
+// generation was recorded.
+func (s *RizinSite) RecordGeneration(description string) (bool, error) {
+	recorded, err := s.recordGeneration(description)
+	if err != nil || !recorded {
+		return recorded, err
+	}
+	if err := s.pruneGenerations(keptGenerations); err != nil {
+		warnf("could not delete the oldest generations: %v", err)
+	}
+	return true, nil
+}
+
+// recordGeneration records the installed packages like RecordGeneration,
+// without pruning any generation
+func (s *RizinSite) recordGeneration(description string) (bool, error) {
+	if err := s.checkExclusive(); err != nil {
+		return false, err
+	}
+
+	archives := map[string]string{}
+	for _, ip := range s.installedPackages {
+		archive, err := generationArchive(ip)
+		if err != nil {
+			return false, err
+		}
+		archives[ip.Name()] = archive
+	}
+	generations, err := s.ListGenerations()
+	if err != nil {
+		return false, err
+	}
+	nextID := 1
+	for _, g := range generations {
+		if g.Current && sameGeneration(g, s.installedPackages, archives) {
+			return false, nil
+		}
+		nextID = g.ID + 1
+	}
+
+	g := Generation{ID: nextID, Created: time.Now().UTC(), Description: description, Packages: []GenerationPackage{}}
+	for _, ip := range s.installedPackages {
+		archivePath := s.generationsPath(generationsStoreDir, archives[ip.Name()])
+		// NOTE: the files of packages installed by v0.1.9 are unknown, they
+		// are recorded without archive and cannot be restored
+		if _, err := os.Stat(archivePath); os.IsNotExist(err) && ip.InstalledFiles != nil {
+			if err := s.archiveInstalledPackage(ip, archivePath); err != nil {
+				return false, fmt.Errorf("could not archive the files of %s: %w", ip.Name(), err)
+			}
+		}
+		g.Packages = append(g.Packages, GenerationPackage{InstalledPackage: ip, Archive: archives[ip.Name()]})
+	}
+
+	by, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(s.generationsPath(), 0755); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(s.generationsPath(strconv.Itoa(g.ID)+".json"), by, 0644, false); err != nil {
+		return false, err
+	}
+	if err := s.setCurrentGeneration(g.ID); err != nil {
+		return false, err
+	}
+	fmt.Printf("Recorded generation %d.\n", g.ID)
+	return true, nil
+}
+
+// stageGeneration extracts the archives of the given packages in a new
+// directory inside the install prefix, one directory per package, so that
+// their files can be renamed in place. It returns the staging directory.
+func (s *RizinSite) stageGeneration(packages []GenerationPackage) (string, error) {
+	if err := os.MkdirAll(s.GetPrefix(), 0755); err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(s.GetPrefix(), ".rz-pm-generation-")
+	if err != nil {
+		return "", err
+	}
+	for _, p := range packages {
+		f, err := os.Open(s.generationsPath(generationsStoreDir, p.Archive))
+		if err == nil {
+			err = extractFilesArchive(f, filepath.Join(staging, p.Name()))
+			f.Close()
+		}
+		if err != nil {
+			os.RemoveAll(staging)
+			return "", fmt.Errorf("could not extract the files of %s: %w", p.Name(), err)
+		}
+	}
+	return staging, nil
+}
+
+// placeStagedFiles renames the files staged in dir to the same path in the
+// install prefix, appending the paths it replaced to placed
+func (s *RizinSite) placeStagedFiles(dir string, placed *[]string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(s.GetPrefix(), rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+		*placed = append(*placed, target)
+		return nil
+	})
+}
+
+// applyGeneration changes the installed packages to the ones of g. The
+// packages that are not installed in g, or installed differently, are
+// removed, and the others are extracted from their archives beforehand in a
+// staging directory, then renamed in place. The installed state is replaced
+// once all the files are in place, and the files are restored from the
+// archives of the installed packages, recorded in the current generation, if
+// anything fails before. The files are replaced one at a time, so this is not
+// atomic: when interrupted, the prefix mixes the files of both generations
+// until g is applied again.
+func (s *RizinSite) applyGeneration(g Generation) (err error) {
+	target := map[string]GenerationPackage{}
+	for _, p := range g.Packages {
+		target[p.Name()] = p
+	}
+	kept := map[string]bool{}
+	removed := []InstalledPackage{}
+	for _, ip := range s.installedPackages {
+		if archive, err := generationArchive(ip); err == nil && target[ip.Name()].Archive == archive {
+			kept[ip.Name()] = true
+		} else if ip.InstalledFiles == nil {
+			return fmt.Errorf("the files of %s were installed by an older rz-pm and cannot be removed, uninstall it first", ip.Name())
+		} else {
+			removed = append(removed, ip)
+		}
+	}
+	restored := []GenerationPackage{}
+	for _, p := range g.Packages {
+		if kept[p.Name()] {
+			continue
+		}
+		if p.InstalledFiles == nil {
+			return fmt.Errorf("the files of %s %s in generation %d were not recorded, it cannot be restored", p.Name(), p.Version(), g.ID)
+		}
+		if _, err := os.Stat(s.generationsPath(generationsStoreDir, p.Archive)); err != nil {
+			return fmt.Errorf("the files of %s in generation %d are not available: %w", p.Name(), g.ID, err)
+		}
+		restored = append(restored, p)
+	}
+
+	staging, err := s.stageGeneration(restored)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	placed := []string{}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// put back the installed packages
+		for _, f := range placed {
+			os.Remove(f)
+		}
+		for _, ip := range removed {
+			archive, _ := generationArchive(ip)
+			if restoreErr := s.restoreArchive(ip, s.generationsPath(generationsStoreDir, archive)); restoreErr != nil {
+				warnf("could not restore the files of %s: %v", ip.Name(), restoreErr)
+			}
+		}
+	}()
+
+	for _, ip := range removed {
+		fmt.Printf("Removing the files of %s %s...\n", ip.Name(), ip.Version())
+		s.removeInstalledFiles(ip)
+	}
+	for _, p := range restored {
+		fmt.Printf("Restoring %s %s...\n", p.Name(), p.Version())
+		if err := s.placeStagedFiles(filepath.Join(staging, p.Name()), &placed); err != nil {
+			return fmt.Errorf("could not restore the files of %s: %w", p.Name(), err)
+		}
+	}
+
+	// the files are in place, the plugins of the disabled packages are
+	// moved to where they are kept
+	for _, ip := range removed {
+		s.dropDisabledPlugins(ip.Name())
+	}
+	installed := []InstalledPackage{}
+	for _, p := range g.Packages {
+		ip := p.InstalledPackage
+		current, _ := s.GetInstalledPackage(ip.Name())
+		wasDisabled := kept[ip.Name()] && current.Disabled
+		if ip.Disabled != wasDisabled {
+			if err := s.movePlugins(ip, ip.Disabled); err != nil {
+				warnf("could not move the plugins of %s: %v", ip.Name(), err)
+				ip.Disabled = wasDisabled
+			} else if !ip.Disabled {
+				s.dropDisabledPlugins(ip.Name())
+			}
+		}
+		installed = append(installed, ip)
+	}
+
+	installedFilePath := filepath.Join(s.Path, installedFile)
+	if err := updateInstalledPackages(installedFilePath, installed); err != nil {
+		return err
+	}
+	s.installedPackages = installed
+	return nil
+}
+
+// SwitchGeneration changes the installed packages to the ones of the
+// generation with the given id, restoring their files from the archives
+// recorded with it, without building anything. The installed packages are
+// recorded first if they changed since the current generation, and they
+// are restored if the switch fails.
+func (s *RizinSite) SwitchGeneration(id int) (err error) {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	defer func() { s.recordHistoryEntry(HistoryEntry{Operation: OperationSwitch, Generation: id}, &err) }()
+	g, err := s.readGeneration(id)
+	if err != nil {
+		return err
+	}
+	// not pruned, which could delete the generation to switch to
+	if _, err := s.recordGeneration(fmt.Sprintf("before switching to generation %d", id)); err != nil {
+		return fmt.Errorf("could not record the installed packages: %w", err)
+	}
+
+	if err := s.applyGeneration(g); err != nil {
+		return fmt.Errorf("could not switch to generation %d, the installed packages were kept: %w", id, err)
+	}
+	if err := s.setCurrentGeneration(id); err != nil {
+		return err
+	}
+	fmt.Printf("Switched to generation %d.\n", id)
+	return nil
+}
+
+// DeleteGeneration deletes the generation with the given id, which must not
+// be the current one, and the archives no other generation references
+func (s *RizinSite) DeleteGeneration(id int) error {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	if _, err := s.readGeneration(id); err != nil {
+		return err
+	}
+	if id == s.currentGeneration() {
+		return fmt.Errorf("generation %d is the current one and cannot be deleted", id)
+	}
+	if err := os.Remove(s.generationsPath(strconv.Itoa(id) + ".json")); err != nil {
+		return err
+	}
+	return s.removeUnreferencedArchives()
+}
+
+// pruneGenerations deletes the oldest generations, other than the current
+// one, so that at most keep generations are left, and the archives only
+// they reference
+func (s *RizinSite) pruneGenerations(keep int) error {
+	generations, err := s.ListGenerations()
+	if err != nil {
+		return err
+	}
+	left := len(generations)
+	for _, g := range generations {
+		if left <= keep {
+			break
+		}
+		if g.Current {
+			continue
+		}
+		if err := os.Remove(s.generationsPath(strconv.Itoa(g.ID) + ".json")); err != nil {
+			return err
+		}
+		left--
+	}
+	if left == len(generations) {
+		return nil
+	}
+	return s.removeUnreferencedArchives()
+}
+
+// removeUnreferencedArchives removes the archives of the store that no
+// generation references
+func (s *RizinSite) removeUnreferencedArchives() error {
+	generations, err := s.ListGenerations()
+	if err != nil {
+		return err
+	}
+	referenced := map[string]bool{}
+	for _, g := range generations {
+		for _, p := range g.Packages {
+			referenced[p.Archive] = true
+		}
+	}
+	entries, err := os.ReadDir(s.generationsPath(generationsStoreDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if referenced[e.Name()] {
+			continue
+		}
+		if err := os.Remove(s.generationsPath(generationsStoreDir, e.Name())); err != nil {
+			warnf("could not remove %s: %v", e.Name(), err)
+		}
+	}
+	return nil
+}
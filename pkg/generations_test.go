@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerations(t *testing.T) {
+	site := newTestSite(t)
+
+	pluginsDir := filepath.Join(site.GetPrefix(), defaultUserPluginsDir)
+	first := filesPackage{FakePackage{myName: "first"}, []string{filepath.Join(pluginsDir, "first"+sharedLibraryExt())}}
+	second := filesPackage{FakePackage{myName: "second"}, []string{filepath.Join(pluginsDir, "second"+sharedLibraryExt())}}
+
+	require.NoError(t, site.InstallPackage(first, InstallOptions{}))
+	recorded, err := site.RecordGeneration("install first")
+	require.NoError(t, err)
+	assert.True(t, recorded)
+	recorded, err = site.RecordGeneration("nothing changed")
+	require.NoError(t, err)
+	assert.False(t, recorded, "unchanged packages should not be recorded again")
+
+	require.NoError(t, site.InstallPackage(second, InstallOptions{}))
+	_, err = site.RecordGeneration("install second")
+	require.NoError(t, err)
+
+	generations, err := site.ListGenerations()
+	require.NoError(t, err)
+	require.Len(t, generations, 2)
+	assert.Equal(t, "install first", generations[0].Description)
+	assert.Len(t, generations[0].Packages, 1)
+	assert.Len(t, generations[1].Packages, 2)
+	assert.True(t, generations[1].Current)
+
+	require.NoError(t, site.SwitchGeneration(1))
+	assert.NoFileExists(t, second.files[0])
+	assert.FileExists(t, first.files[0])
+	assert.False(t, site.IsPackageInstalled(second))
+	generations, err = site.ListGenerations()
+	require.NoError(t, err)
+	require.Len(t, generations, 2, "switching to a recorded generation should not record a new one")
+	assert.True(t, generations[0].Current)
+
+	require.NoError(t, site.SwitchGeneration(2))
+	content, err := os.ReadFile(second.files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+	assert.True(t, site.IsPackageInstalled(second))
+
+	assert.Error(t, site.DeleteGeneration(2), "the current generation cannot be deleted")
+	assert.Error(t, site.SwitchGeneration(3))
+	require.NoError(t, site.DeleteGeneration(1))
+	generations, err = site.ListGenerations()
+	require.NoError(t, err)
+	require.Len(t, generations, 1)
+	archives, err := os.ReadDir(filepath.Join(site.Path, generationsDir, generationsStoreDir))
+	require.NoError(t, err)
+	assert.Len(t, archives, 2, "archives still referenced should be kept")
+}
+
+func TestGenerationsKeepDisabledPackages(t *testing.T) {
+	site := newTestSite(t)
+
+	pluginsDir := filepath.Join(site.GetPrefix(), defaultUserPluginsDir)
+	first := filesPackage{FakePackage{myName: "first"}, []string{filepath.Join(pluginsDir, "first"+sharedLibraryExt())}}
+	second := filesPackage{FakePackage{myName: "second"}, []string{filepath.Join(pluginsDir, "second"+sharedLibraryExt())}}
+	require.NoError(t, site.InstallPackage(first, InstallOptions{}))
+	require.NoError(t, site.DisablePackage("first"))
+	_, err := site.RecordGeneration("disable first")
+	require.NoError(t, err)
+
+	require.NoError(t, site.UninstallPackage(first))
+	require.NoError(t, site.InstallPackage(second, InstallOptions{}))
+	_, err = site.RecordGeneration("replace first")
+	require.NoError(t, err)
+
+	require.NoError(t, site.SwitchGeneration(1))
+	installed, err := site.GetInstalledPackage("first")
+	require.NoError(t, err)
+	assert.True(t, installed.Disabled, "restored packages should stay disabled")
+	assert.NoFileExists(t, first.files[0], "the plugins of disabled packages should be held")
+	assert.FileExists(t, filepath.Join(site.Path, disabledDir, "first", defaultUserPluginsDir, "first"+sharedLibraryExt()))
+
+	require.NoError(t, site.EnablePackage("first"))
+	recorded, err := site.RecordGeneration("enable first")
+	require.NoError(t, err)
+	assert.True(t, recorded, "enabling a package changes the generation")
+}
+
+func TestGenerationsWithOlderPackages(t *testing.T) {
+	site := newTestSite(t)
+
+	// installed by v0.1.9, which did not record the files
+	site.installedPackages = append(site.installedPackages, InstalledPackage{InstalledName: "older"})
+	_, err := site.RecordGeneration("older")
+	require.NoError(t, err)
+
+	plugin := filepath.Join(site.GetPrefix(), defaultUserPluginsDir, "older"+sharedLibraryExt())
+	require.NoError(t, site.UpgradePackage(versionedPackage{filesPackage{FakePackage{myName: "older"}, []string{plugin}}, "1.0.0"}, InstallOptions{}))
+	_, err = site.RecordGeneration("upgrade older")
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, site.SwitchGeneration(1), "were not recorded")
+	installed, err := site.GetInstalledPackage("older")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0", installed.Version(), "a failed switch should keep the installed packages")
+	assert.FileExists(t, plugin)
+}
+
+func TestFailedSwitchKeepsPackages(t *testing.T) {
+	site := newTestSite(t)
+
+	pluginsDir := filepath.Join(site.GetPrefix(), defaultUserPluginsDir)
+	first := filesPackage{FakePackage{myName: "first"}, []string{filepath.Join(pluginsDir, "first"+sharedLibraryExt())}}
+	second := filesPackage{FakePackage{myName: "second"}, []string{filepath.Join(pluginsDir, "second"+sharedLibraryExt())}}
+	require.NoError(t, site.InstallPackage(first, InstallOptions{}))
+	_, err := site.RecordGeneration("install first")
+	require.NoError(t, err)
+	require.NoError(t, site.UninstallPackage(first))
+	require.NoError(t, site.InstallPackage(second, InstallOptions{}))
+	_, err = site.RecordGeneration("replace first")
+	require.NoError(t, err)
+
+	generations, err := site.ListGenerations()
+	require.NoError(t, err)
+	archive := filepath.Join(site.Path, generationsDir, generationsStoreDir, generations[0].Packages[0].Archive)
+	require.NoError(t, os.WriteFile(archive, []byte("corrupted"), 0644))
+
+	assert.Error(t, site.SwitchGeneration(1))
+	assert.FileExists(t, second.files[0])
+	assert.NoFileExists(t, first.files[0])
+	assert.True(t, site.IsPackageInstalled(second))
+	assert.False(t, site.IsPackageInstalled(first))
+	entries, err := os.ReadDir(site.GetPrefix())
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), ".rz-pm-generation-", "the staging directory should be removed")
+	}
+}
+
+func TestPruneGenerations(t *testing.T) {
+	site := newTestSite(t)
+
+	pluginsDir := filepath.Join(site.GetPrefix(), defaultUserPluginsDir)
+	for _, name := range []string{"first", "second", "third"} {
+		require.NoError(t, site.InstallPackage(filesPackage{FakePackage{myName: name}, []string{filepath.Join(pluginsDir, name+sharedLibraryExt())}}, InstallOptions{}))
+		_, err := site.RecordGeneration("install " + name)
+		require.NoError(t, err)
+		if name != "third" {
+			require.NoError(t, site.UninstallPackage(FakePackage{myName: name}))
+		}
+	}
+	require.NoError(t, site.SwitchGeneration(1))
+
+	require.NoError(t, site.pruneGenerations(2))
+	generations, err := site.ListGenerations()
+	require.NoError(t, err)
+	require.Len(t, generations, 2)
+	assert.Equal(t, 1, generations[0].ID, "the current generation should be kept")
+	assert.Equal(t, 3, generations[1].ID)
+	archives, err := os.ReadDir(filepath.Join(site.Path, generationsDir, generationsStoreDir))
+	require.NoError(t, err)
+	assert.Len(t, archives, 2, "the archives of deleted generations should be removed")
+}
@@ -0,0 +1,317 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// historyFile is the log of the operations done on the site, one JSON
+// entry per line, oldest first
+const historyFile string = "history.jsonl"
+
+// RzPmVersion is recorded in the history, it is set by the rz-pm command
+var RzPmVersion = "unknown"
+
+const (
+	OperationInstall   = "install"
+	OperationUninstall = "uninstall"
+	OperationClean     = "clean"
+	OperationUpgrade   = "upgrade"
+	OperationRebuild   = "rebuild"
+	OperationRollback  = "rollback"
+	OperationSwitch    = "switch"
+)
+
+// historyArchiveDir holds the archives of the uninstalled packages, next to
+// their installed state entry, so that the uninstalls can be undone
+const historyArchiveDir string = "history"
+
+// keptUninstallArchives is how many of the last uninstalls can be undone,
+// the archives of the older ones are deleted
+const keptUninstallArchives = 20
+
+const (
+	HistoryOK     = "ok"
+	HistoryFailed = "failed"
+)
+
+type HistoryEntry struct {
+	ID           int       `json:"id"`
+	Time         time.Time `json:"time"`
+	User         string    `json:"user"`
+	RzPmVersion  string    `json:"rz_pm_version"`
+	RizinVersion string    `json:"rizin_version"`
+	Operation    string    `json:"operation"`
+	Package      string    `json:"package"`
+	Version      string    `json:"version,omitempty"`
+	Result       string    `json:"result"`
+	Error        string    `json:"error,omitempty"`
+	// Undo is the id of the entry this operation undid, if any
+	Undo int `json:"undo,omitempty"`
+	// Generation is the generation switched to, for switches
+	Generation int `json:"generation,omitempty"`
+	// Archive holds the files of an uninstalled package, in the history
+	// directory of the site, to undo the uninstall
+	Archive string `json:"archive,omitempty"`
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// History returns the operations recorded in the site, oldest first
+func (s *RizinSite) History() ([]HistoryEntry, error) {
+	f, err := os.Open(filepath.Join(s.Path, historyFile))
+	if os.IsNotExist(err) {
+		return []HistoryEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []HistoryEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// e.g. a line cut short by a crash
+			log.Printf("Skipping invalid history entry: %v", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// recordHistory appends the result of an operation on the package called
+// name to the history. It is meant to be deferred by the operations, with
+// a pointer to the error they return.
+func (s *RizinSite) recordHistory(operation string, name string, version string, errp *error) {
+	s.recordHistoryEntry(HistoryEntry{Operation: operation, Package: name, Version: version}, errp)
+}
+
+// recordHistoryEntry completes entry, which has at least its operation, with
+// the context of the operation and its result, and appends it to the history
+func (s *RizinSite) recordHistoryEntry(entry HistoryEntry, errp *error) {
+	entry.Time = time.Now().UTC()
+	entry.User = currentUser()
+	entry.RzPmVersion = RzPmVersion
+	entry.RizinVersion = s.RizinVersion()
+	entry.Result = HistoryOK
+	entry.Undo = s.undoing
+	if errp != nil && *errp != nil {
+		entry.Result = HistoryFailed
+		entry.Error = (*errp).Error()
+	}
+	if err := s.appendHistory(entry); err != nil {
+		warnf("could not record %s of %s in the history: %v", entry.Operation, entry.Package, err)
+	}
+	if entry.Archive != "" {
+		if err := s.pruneHistoryArchives(keptUninstallArchives); err != nil {
+			warnf("could not delete the archives of older uninstalls: %v", err)
+		}
+	}
+}
+
+// appendHistory appends entry to the history, numbering it after the lines
+// already there, including invalid ones, which the history never rewrites.
+func (s *RizinSite) appendHistory(entry HistoryEntry) error {
+	f, err := os.OpenFile(filepath.Join(s.Path, historyFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lines := 0
+	last := byte('\n')
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if n > 0 {
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	line := []byte{}
+	if last != '\n' {
+		// a line cut short by a crash
+		line = append(line, '\n')
+		lines++
+	}
+	entry.ID = lines + 1
+	by, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(append(line, by...), '\n')
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s *RizinSite) historyArchivePaths(archive string) (string, string) {
+	dir := filepath.Join(s.Path, historyArchiveDir)
+	return filepath.Join(dir, archive), filepath.Join(dir, strings.TrimSuffix(archive, ".tar.gz")+".json")
+}
+
+// saveUninstalled keeps the rollback archive of ip, saved by saveRollback
+// before it is uninstalled, in the history directory, where later
+// operations on the same package do not replace it. It returns the name of
+// the archive, recorded in the history entry of the uninstall.
+func (s *RizinSite) saveUninstalled(ip InstalledPackage) (string, error) {
+	archive, err := generationArchive(ip)
+	if err != nil {
+		return "", err
+	}
+	archivePath, entryPath := s.historyArchivePaths(archive)
+	rollbackArchive, rollbackEntry := s.rollbackPaths(ip.Name())
+	if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+		return "", err
+	}
+	for _, paths := range [][2]string{{rollbackArchive, archivePath}, {rollbackEntry, entryPath}} {
+		os.Remove(paths[1])
+		if err := os.Link(paths[0], paths[1]); err != nil {
+			if err := copyFile(paths[0], paths[1], 0644); err != nil {
+				return "", err
+			}
+		}
+	}
+	return archive, nil
+}
+
+// pruneHistoryArchives deletes the archives of the uninstalls other than the
+// last keep ones of the history
+func (s *RizinSite) pruneHistoryArchives(keep int) error {
+	entries, err := s.History()
+	if err != nil {
+		return err
+	}
+	referenced := map[string]bool{}
+	for i := len(entries) - 1; i >= 0 && len(referenced) < keep; i-- {
+		if entries[i].Archive != "" {
+			referenced[entries[i].Archive] = true
+		}
+	}
+
+	dirEntries, err := os.ReadDir(filepath.Join(s.Path, historyArchiveDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range dirEntries {
+		archive := strings.TrimSuffix(e.Name(), ".json")
+		if archive != e.Name() {
+			archive += ".tar.gz"
+		}
+		if referenced[archive] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.Path, historyArchiveDir, e.Name())); err != nil {
+			warnf("could not remove %s: %v", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// restoreUninstalled installs again the package uninstalled by the history
+// entry, from the archive saved with it
+func (s *RizinSite) restoreUninstalled(entry HistoryEntry) (err error) {
+	defer s.recordHistory(OperationInstall, entry.Package, entry.Version, &err)
+	archivePath, entryPath := s.historyArchivePaths(entry.Archive)
+	var ip InstalledPackage
+	by, err := os.ReadFile(entryPath)
+	if err == nil {
+		err = json.Unmarshal(by, &ip)
+	}
+	if err != nil || ip.Name() != entry.Package || ip.Version() != entry.Version {
+		return fmt.Errorf("the files of %s %s are not available anymore", entry.Package, entry.Version)
+	}
+	if err := s.CheckFileConflicts(ip.Name(), ip.files()); err != nil {
+		return err
+	}
+	if err := s.restoreArchive(ip, archivePath); err != nil {
+		return fmt.Errorf("could not restore the files of %s: %w", ip.Name(), err)
+	}
+	s.installedPackages = append(s.installedPackages, ip)
+	installedFilePath := filepath.Join(s.Path, installedFile)
+	if err := updateInstalledPackages(installedFilePath, s.installedPackages); err != nil {
+		return err
+	}
+	fmt.Printf("Package %s %s installed again.\n", ip.Name(), ip.Version())
+	return nil
+}
+
+// UndoHistory reverts the install or uninstall recorded in the history with
+// the given id. An install is undone by uninstalling the package, if the
+// same version is still installed. An uninstall is undone by restoring the
+// files archived with its history entry, if they were not deleted since
+// then.
+func (s *RizinSite) UndoHistory(id int) error {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	entries, err := s.History()
+	if err != nil {
+		return err
+	}
+	var entry *HistoryEntry
+	for i := range entries {
+		if entries[i].ID == id {
+			entry = &entries[i]
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("no history entry %d", id)
+	}
+	if entry.Result != HistoryOK {
+		return fmt.Errorf("history entry %d is a failed %s, there is nothing to undo", id, entry.Operation)
+	}
+
+	s.undoing = id
+	defer func() { s.undoing = 0 }()
+	switch entry.Operation {
+	case OperationInstall:
+		ip, err := s.GetInstalledPackage(entry.Package)
+		if err != nil || ip.Version() != entry.Version {
+			return fmt.Errorf("package %s %s is not installed anymore", entry.Package, entry.Version)
+		}
+		return s.UninstallPackage(ip)
+	case OperationUninstall:
+		if _, err := s.GetInstalledPackage(entry.Package); err == nil {
+			return fmt.Errorf("package %s is installed again", entry.Package)
+		}
+		if entry.Archive == "" {
+			return fmt.Errorf("the files of %s %s were not archived when it was uninstalled", entry.Package, entry.Version)
+		}
+		return s.restoreUninstalled(*entry)
+	default:
+		return fmt.Errorf("only installs and uninstalls can be undone, history entry %d is a %s", id, entry.Operation)
+	}
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	site := newTestSite(t)
+
+	p := filesPackage{FakePackage{myName: "x"}, []string{filepath.Join(site.GetPrefix(), "share", "x", "data.sdb")}}
+	require.NoError(t, site.InstallPackage(p, InstallOptions{}))
+	assert.Error(t, site.InstallPackage(p, InstallOptions{}))
+	require.NoError(t, site.UninstallPackage(p))
+
+	entries, err := site.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, 1, entries[0].ID)
+	assert.Equal(t, OperationInstall, entries[0].Operation)
+	assert.Equal(t, "x", entries[0].Package)
+	assert.Equal(t, "0.8.1", entries[0].RizinVersion)
+	assert.Equal(t, HistoryOK, entries[0].Result)
+	assert.Equal(t, HistoryFailed, entries[1].Result)
+	assert.Contains(t, entries[1].Error, "already installed")
+	assert.Equal(t, OperationUninstall, entries[2].Operation)
+
+	assert.Error(t, site.UndoHistory(2), "failed operations cannot be undone")
+	assert.Error(t, site.UndoHistory(1), "the package is not installed anymore")
+
+	require.NoError(t, site.UndoHistory(3))
+	content, err := os.ReadFile(p.files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(content))
+	assert.True(t, site.IsPackageInstalled(p))
+
+	require.NoError(t, site.UndoHistory(1))
+	assert.NoFileExists(t, p.files[0])
+	assert.False(t, site.IsPackageInstalled(p))
+
+	entries, err = site.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	assert.Equal(t, OperationInstall, entries[3].Operation)
+	assert.Equal(t, 3, entries[3].Undo)
+	assert.Equal(t, OperationUninstall, entries[4].Operation)
+	assert.Equal(t, 1, entries[4].Undo)
+}
+
+func TestCleanWithoutArtifacts(t *testing.T) {
+	site := newTestSite(t)
+
+	err := site.CleanPackage(FakePackage{myName: "x"})
+	assert.ErrorIs(t, err, ErrNoArtifacts)
+	entries, err := site.History()
+	require.NoError(t, err)
+	assert.Empty(t, entries, "there was nothing to clean")
+}
+
+func TestHistoryIDs(t *testing.T) {
+	site := newTestSite(t)
+
+	p := filesPackage{FakePackage{myName: "x"}, []string{filepath.Join(site.GetPrefix(), "share", "x", "data.sdb")}}
+	require.NoError(t, site.InstallPackage(p, InstallOptions{}))
+	// a line cut short by a crash
+	f, err := os.OpenFile(filepath.Join(site.Path, historyFile), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":2,"operation":"uninst`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, site.UninstallPackage(p))
+	entries, err := site.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 1, entries[0].ID)
+	assert.Equal(t, 3, entries[1].ID, "the invalid line should keep its id")
+	assert.Equal(t, OperationUninstall, entries[1].Operation)
+}
+
+func TestUndoUninstallAfterReinstall(t *testing.T) {
+	site := newTestSite(t)
+
+	file := filepath.Join(site.GetPrefix(), "share", "x", "data.sdb")
+	v1 := versionedPackage{filesPackage{FakePackage{myName: "x"}, []string{file}}, "1.0.0"}
+	v2 := versionedPackage{filesPackage{FakePackage{myName: "x"}, []string{file}}, "2.0.0"}
+	require.NoError(t, site.InstallPackage(v1, InstallOptions{}))
+	require.NoError(t, site.UninstallPackage(v1))
+	require.NoError(t, site.InstallPackage(v2, InstallOptions{}))
+	require.NoError(t, site.UninstallPackage(v2))
+
+	entries, err := site.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.NotEmpty(t, entries[1].Archive, "uninstalls should reference their archive")
+
+	require.NoError(t, site.UndoHistory(2), "later uninstalls should not replace the archive")
+	installed, err := site.GetInstalledPackage("x")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0", installed.Version())
+	assert.FileExists(t, file)
+}
+
+func TestHistoryRollbackAndSwitch(t *testing.T) {
+	site := newTestSite(t)
+
+	file := filepath.Join(site.GetPrefix(), "share", "x", "data.sdb")
+	require.NoError(t, site.InstallPackage(versionedPackage{filesPackage{FakePackage{myName: "x"}, []string{file}}, "1.0.0"}, InstallOptions{}))
+	_, err := site.RecordGeneration("install x")
+	require.NoError(t, err)
+	require.NoError(t, site.UpgradePackage(versionedPackage{filesPackage{FakePackage{myName: "x"}, []string{file}}, "2.0.0"}, InstallOptions{}))
+	_, err = site.RecordGeneration("upgrade x")
+	require.NoError(t, err)
+	require.NoError(t, site.RollbackPackage("x"))
+	require.NoError(t, site.SwitchGeneration(2))
+
+	entries, err := site.History()
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, OperationRollback, entries[2].Operation)
+	assert.Equal(t, "1.0.0", entries[2].Version)
+	assert.Equal(t, OperationSwitch, entries[3].Operation)
+	assert.Equal(t, 2, entries[3].Generation)
+	assert.Equal(t, HistoryOK, entries[3].Result)
+}
+
+func TestPruneHistoryArchives(t *testing.T) {
+	site := newTestSite(t)
+
+	for _, name := range []string{"first", "second"} {
+		p := filesPackage{FakePackage{myName: name}, []string{filepath.Join(site.GetPrefix(), "share", name, "data.sdb")}}
+		require.NoError(t, site.InstallPackage(p, InstallOptions{}))
+		require.NoError(t, site.UninstallPackage(p))
+	}
+	require.NoError(t, site.pruneHistoryArchives(1))
+
+	assert.ErrorContains(t, site.UndoHistory(2), "not available anymore")
+	require.NoError(t, site.UndoHistory(4))
+	archives, err := os.ReadDir(filepath.Join(site.Path, historyArchiveDir))
+	require.NoError(t, err)
+	assert.Len(t, archives, 2, "the archive of the last uninstall and its entry should be kept")
+}
@@ -0,0 +1,375 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const lockFileName string = "site.lock"
+
+// databaseLockFileName is locked while the database of the site is updated,
+// so that instances sharing the site do not update it at the same time
+const databaseLockFileName string = "db.lock"
+
+// lockPollInterval is how often a waiting process retries to take the lock
+const lockPollInterval = 500 * time.Millisecond
+
+// staleEmptyLockAge is the age after which a lock file without an owner is
+// considered stale, where the OS cannot tell whether the lock is held. Such
+// files are left by older rz-pm versions, or are being written right now.
+const staleEmptyLockAge = time.Minute
+
+var errLockBusy = errors.New("lock is held by another process")
+var errLockRetry = errors.New("lock file was replaced")
+
+var processStartTime = time.Now()
+
+// LockMode is the kind of access to the site an instance of rz-pm needs.
+type LockMode int
+
+const (
+	// LockExclusive is needed to modify the site, only one instance at a
+	// time can hold it
+	LockExclusive LockMode = iota
+	// LockShared is enough to read the site, any number of instances can
+	// hold it as long as nobody holds LockExclusive
+	LockShared
+)
+
+// lockOwner identifies the process holding the site lock. It is written in
+// the lock file, so that other instances can tell who they are waiting for.
+type lockOwner struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	StartTime time.Time `json:"start_time"`
+}
+
+func (o *lockOwner) String() string {
+	if o == nil {
+		return "another process"
+	}
+	return fmt.Sprintf("process %d on %s, started at %s", o.PID, o.Hostname, o.StartTime.Format(time.RFC3339))
+}
+
+type SiteLock struct {
+	sync.Locker
+	path             string
+	name             string
+	mode             LockMode
+	file             *os.File
+	locked           bool
+	mu               sync.Mutex
+	interruptSignals chan os.Signal
+	interruptCleanup chan struct{}
+}
+
+func newSiteLock(path string, mode LockMode) *SiteLock {
+	return &SiteLock{
+		mu:     sync.Mutex{},
+		locked: false,
+		path:   filepath.Join(path, lockFileName),
+		name:   "site lock",
+		mode:   mode,
+	}
+}
+
+// newDatabaseLock returns the lock of the database directory dbPath, which
+// is independent of the lock of the site
+func newDatabaseLock(dbPath string) *SiteLock {
+	return &SiteLock{
+		mu:     sync.Mutex{},
+		locked: false,
+		path:   filepath.Join(filepath.Dir(dbPath), databaseLockFileName),
+		name:   "database lock",
+		mode:   LockExclusive,
+	}
+}
+
+// Lock takes the site lock, failing with ErrSiteLocked when another process
+// holds it. Locks left behind by processes that are gone are broken.
+func (sl *SiteLock) Lock() error {
+	return sl.lock(false)
+}
+
+// LockWait takes the site lock, waiting for other processes to release it.
+func (sl *SiteLock) LockWait() error {
+	return sl.lock(true)
+}
+
+func (sl *SiteLock) lock(wait bool) error {
+	// take complete ownership of the struct
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.locked {
+		return fmt.Errorf("%s is already active", sl.name)
+	}
+
+	waiting := false
+	for {
+		owner, err := sl.tryLock()
+		if err == nil {
+			break
+		} else if errors.Is(err, errLockRetry) {
+			continue
+		} else if !errors.Is(err, errLockBusy) {
+			return err
+		}
+
+		if !wait {
+			return fmt.Errorf("%w by %s", ErrSiteLocked, owner)
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "Waiting for the %s held by %s...\n", sl.name, owner)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	sl.locked = true
+	sl.startInterruptCleanup()
+	return nil
+}
+
+// tryLock makes a single attempt at taking the lock. It returns errLockBusy,
+// together with the owner when known, if another process holds it.
+func (sl *SiteLock) tryLock() (*lockOwner, error) {
+	if !fileLockingSupported {
+		return sl.tryCreateLock()
+	}
+
+	f, err := os.OpenFile(sl.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %s: %w", sl.path, err)
+	}
+
+	err = lockFile(f, sl.mode)
+	if errors.Is(err, errLockBusy) {
+		owner, _ := readLockOwner(f)
+		f.Close()
+		return owner, errLockBusy
+	} else if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not lock %s: %w", sl.path, err)
+	}
+
+	// the lock file is removed when the lock is released, so the file we
+	// locked might not be the one at sl.path anymore
+	if !isFileAt(f, sl.path) {
+		_ = unlockFile(f)
+		f.Close()
+		return nil, errLockRetry
+	}
+
+	// nobody else holds the lock exclusively, any owner still in the file is
+	// gone
+	if owner, err := readLockOwner(f); err == nil {
+		warnf("breaking stale %s of %s", sl.name, owner)
+	}
+
+	if sl.mode == LockShared {
+		// only exclusive owners are recorded, there can be many shared ones
+		err = f.Truncate(0)
+	} else {
+		err = writeLockOwner(f)
+	}
+	if err != nil {
+		_ = unlockFile(f)
+		f.Close()
+		return nil, err
+	}
+	sl.file = f
+	return nil, nil
+}
+
+// tryCreateLock takes the lock by creating the lock file exclusively, for
+// systems without file locking. Shared locks are exclusive as well there.
+// Stale locks can only be detected for owners running on the same host.
+func (sl *SiteLock) tryCreateLock() (*lockOwner, error) {
+	f, err := os.OpenFile(sl.path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if os.IsExist(err) {
+		owner, stale := isStaleLock(sl.path)
+		if !stale {
+			return owner, errLockBusy
+		}
+		warnf("breaking stale %s of %s", sl.name, owner)
+		err = os.Remove(sl.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not remove stale lock file %s: %w", sl.path, err)
+		}
+		return nil, errLockRetry
+	} else if err != nil {
+		return nil, fmt.Errorf("could not create lock file %s: %w", sl.path, err)
+	}
+
+	err = writeLockOwner(f)
+	if err != nil {
+		f.Close()
+		os.Remove(sl.path)
+		return nil, err
+	}
+	sl.file = f
+	return nil, nil
+}
+
+func (sl *SiteLock) Unlock() error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if !sl.locked {
+		return fmt.Errorf("%s is not active", sl.name)
+	}
+
+	if sl.interruptSignals != nil {
+		signal.Stop(sl.interruptSignals)
+		close(sl.interruptCleanup)
+		sl.interruptSignals = nil
+		sl.interruptCleanup = nil
+	}
+
+	if sl.file != nil && sl.mode == LockShared {
+		// other instances might still share the lock, the file can only be
+		// removed when nobody else holds it
+		_ = unlockFile(sl.file)
+		if lockFile(sl.file, LockExclusive) != nil || !isFileAt(sl.file, sl.path) {
+			sl.file.Close()
+			sl.file = nil
+			sl.locked = false
+			return nil
+		}
+	}
+
+	// remove the file while still holding the lock, so that waiting processes
+	// notice it is gone instead of locking a file nobody else can see
+	removeErr := os.Remove(sl.path)
+	if sl.file != nil {
+		_ = unlockFile(sl.file)
+		sl.file.Close()
+		sl.file = nil
+	}
+	sl.locked = false
+
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		// windows does not remove files that are still open
+		removeErr = os.Remove(sl.path)
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			return fmt.Errorf("could not remove lock file %s: %w", sl.path, removeErr)
+		}
+	}
+	return nil
+}
+
+func (sl *SiteLock) startInterruptCleanup() {
+	signals := make(chan os.Signal, 1)
+	cleanupDone := make(chan struct{})
+
+	sl.interruptSignals = signals
+	sl.interruptCleanup = cleanupDone
+	signal.Notify(signals, os.Interrupt)
+
+	go func() {
+		select {
+		case <-cleanupDone:
+			return
+		case <-signals:
+			_ = sl.Unlock()
+			os.Exit(130)
+		}
+	}()
+}
+
+func isFileAt(f *os.File, path string) bool {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fileInfo, pathInfo)
+}
+
+func readLockOwner(f *os.File) (*lockOwner, error) {
+	content, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+
+	var owner lockOwner
+	err = json.Unmarshal(content, &owner)
+	if err != nil {
+		return nil, err
+	}
+	if owner.PID == 0 {
+		return nil, fmt.Errorf("lock file has no owner")
+	}
+	return &owner, nil
+}
+
+func writeLockOwner(f *os.File) error {
+	hostname, _ := os.Hostname()
+	by, err := json.Marshal(lockOwner{
+		PID:       os.Getpid(),
+		Hostname:  hostname,
+		StartTime: processStartTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt(by, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("could not write lock file %s: %w", f.Name(), err)
+	}
+	return nil
+}
+
+// isStaleLock reports whether the owner of the lock file at path is gone.
+// Owners on other hosts are never considered gone.
+func isStaleLock(path string) (*lockOwner, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	owner, err := readLockOwner(f)
+	if err != nil {
+		info, err := f.Stat()
+		return nil, err == nil && time.Since(info.ModTime()) > staleEmptyLockAge
+	}
+
+	hostname, _ := os.Hostname()
+	return owner, owner.Hostname == hostname && !processAlive(owner.PID)
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess already fails for processes that do not exist
+		p.Release()
+		return true
+	}
+
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
@@ -0,0 +1,17 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris || windows)
+
+package pkg
+
+import "os"
+
+// without file locking the lock file is created exclusively, see
+// SiteLock.tryCreateLock
+const fileLockingSupported = false
+
+func lockFile(f *os.File, mode LockMode) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
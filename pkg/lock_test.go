@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSiteLockOwner(t *testing.T) {
+	sitePath := t.TempDir()
+	lock := newSiteLock(sitePath, LockExclusive)
+	require.NoError(t, lock.Lock())
+
+	content, err := os.ReadFile(filepath.Join(sitePath, lockFileName))
+	require.NoError(t, err)
+	var owner lockOwner
+	require.NoError(t, json.Unmarshal(content, &owner))
+	assert.Equal(t, os.Getpid(), owner.PID)
+	assert.False(t, owner.StartTime.IsZero())
+
+	err = newSiteLock(sitePath, LockExclusive).Lock()
+	assert.ErrorIs(t, err, ErrSiteLocked)
+	assert.ErrorContains(t, err, owner.String(), "the error should tell who holds the lock")
+
+	require.NoError(t, lock.Unlock())
+	_, err = os.Stat(filepath.Join(sitePath, lockFileName))
+	assert.True(t, os.IsNotExist(err), "lock file should be removed on unlock")
+}
+
+func TestSiteLockStale(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a command whose process is gone")
+	}
+
+	// a process that is surely gone
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+
+	sitePath := t.TempDir()
+	hostname, _ := os.Hostname()
+	by, err := json.Marshal(lockOwner{PID: cmd.Process.Pid, Hostname: hostname, StartTime: time.Now()})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(sitePath, lockFileName), by, 0644))
+
+	lock := newSiteLock(sitePath, LockExclusive)
+	require.NoError(t, lock.Lock(), "stale locks should be broken")
+	require.NoError(t, lock.Unlock())
+
+	// lock files of older rz-pm versions are empty
+	lockPath := filepath.Join(sitePath, lockFileName)
+	require.NoError(t, os.WriteFile(lockPath, []byte{}, 0644))
+	old := time.Now().Add(-2 * staleEmptyLockAge)
+	require.NoError(t, os.Chtimes(lockPath, old, old))
+	require.NoError(t, lock.Lock(), "old empty locks should be broken")
+	require.NoError(t, lock.Unlock())
+}
+
+func TestSiteLockWait(t *testing.T) {
+	sitePath := t.TempDir()
+	lock := newSiteLock(sitePath, LockExclusive)
+	require.NoError(t, lock.Lock())
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(2 * lockPollInterval)
+		close(released)
+		assert.NoError(t, lock.Unlock())
+	}()
+
+	waiter := newSiteLock(sitePath, LockExclusive)
+	require.NoError(t, waiter.LockWait())
+	select {
+	case <-released:
+	default:
+		t.Fatal("lock should only be taken after it is released")
+	}
+	require.NoError(t, waiter.Unlock())
+}
+
+func TestSiteLockShared(t *testing.T) {
+	if !fileLockingSupported {
+		t.Skip("shared locks are exclusive without file locking")
+	}
+
+	sitePath := t.TempDir()
+	lockPath := filepath.Join(sitePath, lockFileName)
+	reader1 := newSiteLock(sitePath, LockShared)
+	reader2 := newSiteLock(sitePath, LockShared)
+	require.NoError(t, reader1.Lock())
+	require.NoError(t, reader2.Lock(), "shared locks should not block each other")
+
+	err := newSiteLock(sitePath, LockExclusive).Lock()
+	assert.ErrorIs(t, err, ErrSiteLocked, "exclusive locks should wait for readers")
+
+	require.NoError(t, reader1.Unlock())
+	_, err = os.Stat(lockPath)
+	assert.NoError(t, err, "lock file should be kept while other readers hold it")
+	require.NoError(t, reader2.Unlock())
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err), "the last reader should remove the lock file")
+
+	writer := newSiteLock(sitePath, LockExclusive)
+	require.NoError(t, writer.Lock())
+	err = newSiteLock(sitePath, LockShared).Lock()
+	assert.ErrorIs(t, err, ErrSiteLocked, "shared locks should wait for writers")
+	require.NoError(t, writer.Unlock())
+}
@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// lockfileVersion is the schema version of the lockfiles written by rz-pm
+const lockfileVersion = 1
+
+// Lockfile describes an exact set of installed packages, to reproduce it on
+// other machines
+type Lockfile struct {
+	Version        int             `json:"version"`
+	RizinVersion   string          `json:"rizin_version"`
+	DatabaseCommit string          `json:"database_commit,omitempty"`
+	Packages       []LockedPackage `json:"packages"`
+}
+
+type LockedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	Hash    string `json:"hash,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+}
+
+// Commit returns the commit of the database currently checked out
+func (d Database) Commit() (string, error) {
+	return gitCommit(d.Path)
+}
+
+// ReadLockfile reads a lockfile written by ExportLockfile
+func ReadLockfile(path string) (Lockfile, error) {
+	by, err := os.ReadFile(path)
+	if err != nil {
+		return Lockfile{}, err
+	}
+	var lf Lockfile
+	if err := json.Unmarshal(by, &lf); err != nil {
+		return Lockfile{}, fmt.Errorf("invalid lockfile %s: %w", path, err)
+	}
+	if lf.Version != lockfileVersion {
+		return Lockfile{}, fmt.Errorf("lockfile version %d is not supported, upgrade rz-pm", lf.Version)
+	}
+	return lf, nil
+}
+
+// ExportLockfile returns the lockfile of the installed packages. It fails
+// for packages whose source was not recorded, which were installed by older
+// versions of rz-pm or from a local file.
+func (s *RizinSite) ExportLockfile() (Lockfile, error) {
+	lf := Lockfile{Version: lockfileVersion, RizinVersion: s.rizinVersion, Packages: []LockedPackage{}}
+	if commit, err := s.Database.Commit(); err == nil {
+		lf.DatabaseCommit = commit
+	} else {
+		warnf("could not find the database commit: %v", err)
+	}
+
+	for _, p := range s.installedPackages {
+		src := p.InstalledSource
+		if src == nil {
+			return Lockfile{}, fmt.Errorf("the source of package %s is unknown, install it again to export it", p.Name())
+		}
+		if strings.HasSuffix(src.URL, ".git") && src.Commit == "" {
+			return Lockfile{}, fmt.Errorf("the git commit of package %s is unknown, install it again to export it", p.Name())
+		}
+		lf.Packages = append(lf.Packages, LockedPackage{
+			Name:    p.Name(),
+			Version: p.Version(),
+			URL:     src.URL,
+			Hash:    src.Hash,
+			Commit:  src.Commit,
+		})
+	}
+	return lf, nil
+}
+
+// matchesLock reports whether the installed package is exactly the locked one
+func (ip InstalledPackage) matchesLock(lp LockedPackage) bool {
+	src := ip.InstalledSource
+	return src != nil && ip.InstalledVersion == lp.Version && src.URL == lp.URL && src.Hash == lp.Hash && src.Commit == lp.Commit
+}
+
+// lockedPackage returns the database package matching lp, pinned to the
+// locked git commit, or an error describing why it does not match.
+func (s *RizinSite) lockedPackage(lp LockedPackage) (Package, error) {
+	p, err := s.GetPackage(lp.Name)
+	if err != nil {
+		return nil, err
+	}
+	rp, ok := p.(RizinPackage)
+	if !ok || rp.PackageSource == nil {
+		return nil, fmt.Errorf("package %s has no source in the database", lp.Name)
+	}
+
+	source := *rp.PackageSource
+	switch {
+	case rp.PackageVersion != lp.Version:
+		return nil, fmt.Errorf("package %s is at version %s in the database, not %s", lp.Name, rp.PackageVersion, lp.Version)
+	case redactURL(source.URL) != lp.URL:
+		return nil, fmt.Errorf("package %s is downloaded from %s in the database, not %s", lp.Name, redactURL(source.URL), lp.URL)
+	case source.Hash != lp.Hash:
+		return nil, fmt.Errorf("package %s has hash %q in the database, not %q", lp.Name, source.Hash, lp.Hash)
+	case source.Commit != "" && source.Commit != lp.Commit:
+		return nil, fmt.Errorf("package %s is pinned to commit %s in the database, not %s", lp.Name, source.Commit, lp.Commit)
+	}
+	if rp.isGitRepo() {
+		if lp.Commit == "" {
+			return nil, fmt.Errorf("package %s has no git commit in the lockfile", lp.Name)
+		}
+		source.Commit = lp.Commit
+	}
+	rp.PackageSource = &source
+	return rp, nil
+}
+
+// InstallFromLockfile installs exactly the packages of lf, upgrading or
+// reinstalling the ones installed with a different version or source. Every
+// package is checked against the database before anything is installed, and
+// any mismatch, including of the rizin version, is an error.
+func (s *RizinSite) InstallFromLockfile(lf Lockfile, opts InstallOptions) error {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	if lf.RizinVersion != s.rizinVersion {
+		return fmt.Errorf("the lockfile requires rizin %s, but rizin %s is in use", lf.RizinVersion, s.rizinVersion)
+	}
+	if commit, err := s.Database.Commit(); err == nil && lf.DatabaseCommit != "" && commit != lf.DatabaseCommit {
+		warnf("the lockfile was made with database commit %s, but %s is in use", lf.DatabaseCommit, commit)
+	}
+
+	locked := map[string]bool{}
+	packages := []Package{}
+	errs := []string{}
+	for _, lp := range lf.Packages {
+		locked[lp.Name] = true
+		p, err := s.lockedPackage(lp)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		packages = append(packages, p)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("the lockfile cannot be matched exactly:\n  %s", strings.Join(errs, "\n  "))
+	}
+
+	for i, p := range packages {
+		lp := lf.Packages[i]
+		installed, err := s.GetInstalledPackage(p.Name())
+		switch {
+		case err != nil:
+			err = s.InstallPackage(p, opts)
+		case installed.matchesLock(lp):
+			fmt.Printf("Package %s %s is already installed.\n", lp.Name, lp.Version)
+			continue
+		default:
+			err = s.UpgradePackage(p, opts)
+		}
+		if err != nil {
+			return err
+		}
+
+		installed, err = s.GetInstalledPackage(p.Name())
+		if err != nil {
+			return err
+		}
+		if !installed.matchesLock(lp) {
+			return fmt.Errorf("package %s was installed, but does not match the lockfile", lp.Name)
+		}
+	}
+
+	for _, p := range s.installedPackages {
+		if !locked[p.Name()] {
+			warnf("package %s is installed but not in the lockfile", p.Name())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestDatabasePackage(t *testing.T, site Site, name string, content string) {
+	t.Helper()
+	dir := filepath.Join(site.GetBaseDir(), dbDir, dbPath)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".yaml"), []byte(content), 0644))
+}
+
+// sourcedPackage is a package built from source
+type sourcedPackage struct {
+	versionedPackage
+	source RizinPackageSource
+}
+
+func (sp sourcedPackage) Source() RizinPackageSource { return sp.source }
+
+func TestLockfile(t *testing.T) {
+	site := newTestSite(t)
+
+	writeTestDatabasePackage(t, site, "archived", `name: archived
+version: 1.0.0
+summary: archived plugin
+source:
+  url: https://example.com/archived-1.0.0.tar.gz
+  hash: aaaa
+  build_system: meson
+`)
+	writeTestDatabasePackage(t, site, "cloned", `name: cloned
+version: dev
+summary: cloned plugin
+source:
+  url: https://example.com/cloned.git
+  build_system: meson
+`)
+	// the clone of the git source, at the commit to lock
+	clonePath := filepath.Join(site.GetArtifactsDir(), "cloned", "dev", "cloned")
+	repo, err := git.PlainInit(clonePath, false)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(clonePath, "plugin.c"), []byte("int main;"), 0644))
+	commitTestDatabase(t, repo, "plugin")
+	head, err := repo.Head()
+	require.NoError(t, err)
+
+	archived := sourcedPackage{versionedPackage{filesPackage{FakePackage{myName: "archived"}, nil}, "1.0.0"}, RizinPackageSource{URL: "https://example.com/archived-1.0.0.tar.gz", Hash: "aaaa"}}
+	cloned := sourcedPackage{versionedPackage{filesPackage{FakePackage{myName: "cloned"}, nil}, "dev"}, RizinPackageSource{URL: "https://example.com/cloned.git"}}
+	require.NoError(t, site.InstallPackage(archived, InstallOptions{}))
+	require.NoError(t, site.InstallPackage(cloned, InstallOptions{}))
+
+	lf, err := site.ExportLockfile()
+	require.NoError(t, err)
+	assert.Equal(t, "0.8.1", lf.RizinVersion)
+	require.Len(t, lf.Packages, 2)
+	assert.Equal(t, LockedPackage{Name: "archived", Version: "1.0.0", URL: "https://example.com/archived-1.0.0.tar.gz", Hash: "aaaa"}, lf.Packages[0])
+
+	require.NoError(t, site.InstallFromLockfile(lf, InstallOptions{}), "the installed packages already match")
+
+	assert.Equal(t, head.Hash().String(), lf.Packages[1].Commit)
+	p, err := site.lockedPackage(lf.Packages[1])
+	require.NoError(t, err)
+	assert.Equal(t, lf.Packages[1].Commit, p.Source().Commit, "git sources should be pinned to the locked commit")
+
+	mismatch := lf
+	mismatch.Packages = []LockedPackage{lf.Packages[0]}
+	mismatch.Packages[0].Hash = "bbbb"
+	err = site.InstallFromLockfile(mismatch, InstallOptions{})
+	assert.ErrorContains(t, err, "cannot be matched exactly")
+
+	mismatch = lf
+	mismatch.RizinVersion = "0.9.0"
+	err = site.InstallFromLockfile(mismatch, InstallOptions{})
+	assert.ErrorContains(t, err, "requires rizin 0.9.0")
+
+	require.NoError(t, site.InstallPackage(filesPackage{FakePackage{myName: "manual"}, nil}, InstallOptions{}))
+	_, err = site.ExportLockfile()
+	assert.ErrorContains(t, err, "source of package manual is unknown")
+}
+
+func TestExportWithUnreadableDatabaseEntry(t *testing.T) {
+	site := newTestSite(t)
+	writeTestDatabasePackage(t, site, "unreadable", "name: [")
+
+	output := captureStdout(t, func() {
+		_, err := site.ListAvailablePackages()
+		require.NoError(t, err)
+		lf, err := site.ExportLockfile()
+		require.NoError(t, err)
+		require.NoError(t, json.NewEncoder(os.Stdout).Encode(lf))
+	})
+	var lf Lockfile
+	require.NoError(t, json.Unmarshal([]byte(output), &lf), "warnings should not be written with the lockfile")
+	assert.Equal(t, "0.8.1", lf.RizinVersion)
+}
+
+func TestDownloadGitCommit(t *testing.T) {
+	upstream := filepath.Join(t.TempDir(), "plugin.git")
+	repo, err := git.PlainInit(upstream, false)
+	require.NoError(t, err)
+	tree, err := repo.Worktree()
+	require.NoError(t, err)
+	commits := []plumbing.Hash{}
+	for _, content := range []string{"first", "second"} {
+		require.NoError(t, os.WriteFile(filepath.Join(upstream, "version"), []byte(content), 0644))
+		_, err = tree.Add("version")
+		require.NoError(t, err)
+		h, err := tree.Commit(content, &git.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+		require.NoError(t, err)
+		commits = append(commits, h)
+	}
+
+	artifactsDir := t.TempDir()
+	rp := RizinPackage{PackageName: "plugin", PackageVersion: "dev", PackageSource: &RizinPackageSource{URL: upstream, Commit: commits[0].String()}}
+	require.NoError(t, rp.Download(artifactsDir))
+	srcPath := filepath.Join(rp.artifactsPath(artifactsDir), "plugin")
+	content, err := os.ReadFile(filepath.Join(srcPath, "version"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(content), "the pinned commit should be checked out")
+
+	rp.PackageSource.Commit = ""
+	require.NoError(t, rp.Download(artifactsDir))
+	content, err = os.ReadFile(filepath.Join(srcPath, "version"))
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(content), "unpinned sources should follow the branch again")
+}
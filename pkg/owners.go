@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var ErrFileConflict = fmt.Errorf("files are owned by other packages")
+
+type InstallOptions struct {
+	// Force installs a package even when it overwrites files of other
+	// packages, which then lose the ownership of those files.
+	Force bool
+}
+
+// installContext is the site as seen by a package while it is installed
+type installContext struct {
+	*RizinSite
+	opts InstallOptions
+}
+
+func (ic installContext) CheckFileConflicts(pkgName string, files []string) error {
+	err := ic.RizinSite.CheckFileConflicts(pkgName, files)
+	if err != nil && ic.opts.Force {
+		warnf("%v", err)
+		warnf("overwriting them as requested")
+		return nil
+	}
+	return err
+}
+
+func (ic installContext) forced() bool {
+	return ic.opts.Force
+}
+
+// forceInstall tells whether site installs packages even when the files
+// they are going to install could not be checked
+func forceInstall(site Site) bool {
+	fs, ok := site.(interface{ forced() bool })
+	return ok && fs.forced()
+}
+
+// normalizeInstalledPath makes paths comparable with the recorded ones,
+// resolving symbolic links in the directories but not in the file itself.
+func normalizeInstalledPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs))
+	}
+	return abs
+}
+
+// FileOwners returns the installed packages that installed path
+func (s *RizinSite) FileOwners(path string) []InstalledPackage {
+	path = normalizeInstalledPath(path)
+	owners := []InstalledPackage{}
+	for _, p := range s.installedPackages {
+		for _, f := range p.files() {
+			if normalizeInstalledPath(f) == path {
+				owners = append(owners, p)
+				break
+			}
+		}
+	}
+	return owners
+}
+
+// fileConflicts maps the files, among the given ones, installed by packages
+// other than pkgName to their owner
+func (s *RizinSite) fileConflicts(pkgName string, files []string) map[string]string {
+	owned := map[string]string{}
+	for _, p := range s.installedPackages {
+		if p.Name() == pkgName {
+			continue
+		}
+		for _, f := range p.files() {
+			owned[normalizeInstalledPath(f)] = p.Name()
+		}
+	}
+
+	conflicts := map[string]string{}
+	for _, f := range files {
+		if owner, ok := owned[normalizeInstalledPath(f)]; ok {
+			conflicts[f] = owner
+		}
+	}
+	return conflicts
+}
+
+// CheckFileConflicts fails with ErrFileConflict when installing files for
+// pkgName would overwrite files installed by other packages.
+func (s *RizinSite) CheckFileConflicts(pkgName string, files []string) error {
+	conflicts := s.fileConflicts(pkgName, files)
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(conflicts))
+	for p := range conflicts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	lines := []string{}
+	for _, p := range paths {
+		lines = append(lines, fmt.Sprintf("  %s (owned by %s)", p, conflicts[p]))
+	}
+	return fmt.Errorf("%w, package %s would overwrite:\n%s\nuse --force to install it anyway", ErrFileConflict, pkgName, strings.Join(lines, "\n"))
+}
+
+// checkUnknownFiles fails because the files pkgName is going to install
+// could not be listed, for the reason given, so they might overwrite files
+// of other packages, unless force is set.
+func checkUnknownFiles(pkgName string, reason error, force bool) error {
+	err := fmt.Errorf("could not list the files package %s is going to install, which might overwrite files of other packages: %v\nuse --force to install it anyway", pkgName, reason)
+	if force {
+		warnf("%v", err)
+		warnf("installing it anyway as requested")
+		return nil
+	}
+	return err
+}
+
+// takeOverFiles removes the given files from the packages, other than
+// pkgName, that installed them, as they were overwritten by pkgName.
+func (s *RizinSite) takeOverFiles(pkgName string, files []string) {
+	conflicts := s.fileConflicts(pkgName, files)
+	if len(conflicts) == 0 {
+		return
+	}
+
+	taken := map[string]bool{}
+	for f, owner := range conflicts {
+		warnf("%s of package %s is now owned by %s", f, owner, pkgName)
+		taken[normalizeInstalledPath(f)] = true
+	}
+
+	for i, p := range s.installedPackages {
+		if p.Name() == pkgName || p.InstalledFiles == nil {
+			continue
+		}
+		s.installedPackages[i] = p.keepFiles(func(f string) bool { return !taken[normalizeInstalledPath(f)] })
+	}
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// filesPackage installs empty files, checking for conflicts like
+// RizinPackage does.
+type filesPackage struct {
+	FakePackage
+	files []string
+}
+
+func (fp filesPackage) Install(site Site) ([]string, error) {
+	if err := site.CheckFileConflicts(fp.Name(), fp.files); err != nil {
+		return nil, err
+	}
+	for _, f := range fp.files {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(f, []byte(fp.Name()), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return fp.files, nil
+}
+
+func TestFileConflicts(t *testing.T) {
+	site := newTestSite(t)
+
+	pluginsDir := filepath.Join(site.GetPrefix(), "lib", "rizin", "plugins")
+	shared := filepath.Join(pluginsDir, "shared.so")
+	first := filesPackage{FakePackage{myName: "first"}, []string{shared, filepath.Join(pluginsDir, "first.so")}}
+	second := filesPackage{FakePackage{myName: "second"}, []string{shared, filepath.Join(pluginsDir, "second.so")}}
+
+	require.NoError(t, site.InstallPackage(first, InstallOptions{}))
+	owners := site.FileOwners(shared)
+	require.Len(t, owners, 1)
+	assert.Equal(t, "first", owners[0].Name())
+	assert.Empty(t, site.FileOwners(filepath.Join(pluginsDir, "unknown.so")))
+
+	err := site.InstallPackage(second, InstallOptions{})
+	assert.ErrorIs(t, err, ErrFileConflict)
+	assert.ErrorContains(t, err, shared+" (owned by first)")
+	assert.False(t, site.IsPackageInstalled(second))
+
+	require.NoError(t, site.InstallPackage(second, InstallOptions{Force: true}))
+	owners = site.FileOwners(shared)
+	require.Len(t, owners, 1)
+	assert.Equal(t, "second", owners[0].Name(), "forced installs take over the files")
+
+	firstInstalled, err := site.GetInstalledPackage("first")
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(pluginsDir, "first.so")}, firstInstalled.files())
+	require.Len(t, firstInstalled.FileInfo, 1)
+}
+
+// unlistedPackage cannot tell which files it is going to install
+type unlistedPackage struct {
+	filesPackage
+}
+
+func (up unlistedPackage) Install(site Site) ([]string, error) {
+	if err := checkUnknownFiles(up.Name(), fmt.Errorf("no manifest"), forceInstall(site)); err != nil {
+		return nil, err
+	}
+	return up.filesPackage.Install(site)
+}
+
+func TestUnknownFilesNeedForce(t *testing.T) {
+	site := newTestSite(t)
+	p := unlistedPackage{filesPackage{FakePackage{myName: "unlisted"}, []string{filepath.Join(site.GetPrefix(), "lib", "unlisted.so")}}}
+
+	err := site.InstallPackage(p, InstallOptions{})
+	assert.ErrorContains(t, err, "use --force")
+	assert.False(t, site.IsPackageInstalled(p))
+
+	require.NoError(t, site.InstallPackage(p, InstallOptions{Force: true}))
+	assert.True(t, site.IsPackageInstalled(p))
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -18,8 +19,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/adrg/xdg"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 )
 
 type BuildSystem string
@@ -32,8 +34,10 @@ const (
 const gitProgressDotInterval = 2 * time.Second
 
 type RizinPackageSource struct {
-	URL            string
-	Hash           string
+	URL  string
+	Hash string
+	// Commit pins the git commit to build, for git sources
+	Commit         string
 	BuildSystem    BuildSystem `yaml:"build_system"`
 	BuildArguments []string    `yaml:"build_arguments"`
 	Directory      string
@@ -44,7 +48,9 @@ type RizinPackage struct {
 	PackageVersion     string              `yaml:"version"`
 	PackageSummary     string              `yaml:"summary"`
 	PackageDescription string              `yaml:"description"`
+	PackageTags        []string            `yaml:"tags"`
 	PackageSource      *RizinPackageSource `yaml:"source"`
+	PackageCategory    string              `yaml:"-"`
 }
 
 type Package interface {
@@ -52,6 +58,8 @@ type Package interface {
 	Version() string
 	Summary() string
 	Description() string
+	Category() string
+	Tags() []string
 	Source() RizinPackageSource
 	Download(baseArtifactsPath string) error
 	Build(site Site) error
@@ -75,6 +83,16 @@ func (rp RizinPackage) Summary() string {
 	return rp.PackageSummary
 }
 
+// Category returns the database directory the package was found in, relative
+// to db/, or an empty string for packages at the top level.
+func (rp RizinPackage) Category() string {
+	return rp.PackageCategory
+}
+
+func (rp RizinPackage) Tags() []string {
+	return rp.PackageTags
+}
+
 func (rp RizinPackage) Source() RizinPackageSource {
 	if rp.PackageSource == nil {
 		return RizinPackageSource{}
@@ -123,7 +141,13 @@ func gitProjectNameFromURL(url string) string {
 }
 
 func runWithDotProgress(message string, interval time.Duration, fn func() error) error {
-	fmt.Print(message)
+	return runWithDotProgressTo(os.Stdout, message, interval, fn)
+}
+
+// runWithDotProgressTo prints message to out and appends a dot to it every
+// interval until fn returns.
+func runWithDotProgressTo(out io.Writer, message string, interval time.Duration, fn func() error) error {
+	fmt.Fprint(out, message)
 
 	done := make(chan struct{})
 	stopped := make(chan struct{})
@@ -137,7 +161,7 @@ func runWithDotProgress(message string, interval time.Duration, fn func() error)
 			case <-done:
 				return
 			case <-ticker.C:
-				fmt.Print(".")
+				fmt.Fprint(out, ".")
 			}
 		}
 	}()
@@ -145,7 +169,7 @@ func runWithDotProgress(message string, interval time.Duration, fn func() error)
 	err := fn()
 	close(done)
 	<-stopped
-	fmt.Println()
+	fmt.Fprintln(out)
 	return err
 }
 
@@ -154,13 +178,25 @@ func runCommandWithDotProgress(message string, cmd *exec.Cmd) error {
 }
 
 func (rp RizinPackage) downloadTar(artifactsPath string) error {
-	client := http.Client{}
-	resp, err := client.Get(rp.PackageSource.URL)
+	req, err := http.NewRequest(http.MethodGet, rp.PackageSource.URL, nil)
+	if err != nil {
+		return err
+	}
+	err = setHTTPAuth(req)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{CheckRedirect: checkAuthRedirect}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not download %s: %s", redactURL(rp.PackageSource.URL), resp.Status)
+	}
 	tarballFile, err := os.CreateTemp(artifactsPath, "")
 	if err != nil {
 		return err
@@ -287,15 +323,30 @@ func (rp RizinPackage) downloadTar(artifactsPath string) error {
 func (rp RizinPackage) downloadGit(artifactsPath string) error {
 	gitProjectName := gitProjectNameFromURL(rp.PackageSource.URL)
 	projectPath := filepath.Join(artifactsPath, gitProjectName)
+	auth, err := gitAuth(rp.PackageSource.URL)
+	if err != nil {
+		return err
+	}
 	fi, err := os.Stat(projectPath)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	if err == nil && fi.IsDir() {
+	if err == nil && fi.IsDir() && rp.PackageSource.Commit == "" && isDetachedGitRepo(projectPath) {
+		// left at a pinned commit, which cannot be pulled
+		log.Printf("Removing %s to clone it again", projectPath)
+		if err := os.RemoveAll(projectPath); err != nil {
+			return err
+		}
+		fi = nil
+	}
+	if fi != nil && fi.IsDir() {
 		repo, err := git.PlainOpen(projectPath)
 		if err != nil {
 			return err
 		}
+		if rp.PackageSource.Commit != "" {
+			return rp.checkoutGitCommit(repo, auth)
+		}
 
 		tree, err := repo.Worktree()
 		if err != nil {
@@ -307,6 +358,7 @@ func (rp RizinPackage) downloadGit(artifactsPath string) error {
 			gitProgressDotInterval,
 			func() error {
 				return tree.Pull(&git.PullOptions{
+					Auth:              auth,
 					Progress:          nil,
 					RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
 				})
@@ -323,12 +375,15 @@ func (rp RizinPackage) downloadGit(artifactsPath string) error {
 		return err
 	}
 
+	var repo *git.Repository
 	err = runWithDotProgress(
 		fmt.Sprintf("Cloning %s source repository...", rp.PackageName),
 		gitProgressDotInterval,
 		func() error {
-			_, err := git.PlainClone(projectPath, false, &git.CloneOptions{
+			var err error
+			repo, err = git.PlainClone(projectPath, false, &git.CloneOptions{
 				URL:               rp.PackageSource.URL,
+				Auth:              auth,
 				Progress:          nil,
 				RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
 			})
@@ -339,6 +394,56 @@ func (rp RizinPackage) downloadGit(artifactsPath string) error {
 		return err
 	}
 	fmt.Printf("Source repository for %s downloaded.\n", rp.PackageName)
+	if rp.PackageSource.Commit != "" {
+		return rp.checkoutGitCommit(repo, auth)
+	}
+	return nil
+}
+
+// isDetachedGitRepo reports whether the git repository at path has no branch
+// checked out
+func isDetachedGitRepo(path string) bool {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return false
+	}
+	head, err := repo.Head()
+	return err == nil && !head.Name().IsBranch()
+}
+
+// checkoutGitCommit checks out the commit pinned by the package source,
+// fetching it when it is not in the repository yet
+func (rp RizinPackage) checkoutGitCommit(repo *git.Repository, auth transport.AuthMethod) error {
+	hash := plumbing.NewHash(rp.PackageSource.Commit)
+	if _, err := repo.CommitObject(hash); err != nil {
+		err = runWithDotProgress(
+			fmt.Sprintf("Fetching %s source repository...", rp.PackageName),
+			gitProgressDotInterval,
+			func() error {
+				err := repo.Fetch(&git.FetchOptions{Auth: auth, Force: true})
+				if err == git.NoErrAlreadyUpToDate {
+					return nil
+				}
+				return err
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := repo.CommitObject(hash); err != nil {
+			return fmt.Errorf("commit %s of %s not found: %w", rp.PackageSource.Commit, rp.PackageName, err)
+		}
+	}
+
+	tree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	err = tree.Checkout(&git.CheckoutOptions{Hash: hash, Force: true})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Source repository for %s checked out at %s.\n", rp.PackageName, rp.PackageSource.Commit)
 	return nil
 }
 
@@ -349,7 +454,7 @@ func (rp RizinPackage) Download(baseArtifactsPath string) error {
 		return err
 	}
 
-	log.Printf("Downloading package %s... from '%s'", rp.PackageName, rp.PackageSource.URL)
+	log.Printf("Downloading package %s... from '%s'", rp.PackageName, redactURL(rp.PackageSource.URL))
 	artifactsPath := rp.artifactsPath(baseArtifactsPath)
 	err = os.MkdirAll(artifactsPath, os.FileMode(0755))
 	if err != nil {
@@ -376,13 +481,17 @@ func (rp RizinPackage) buildMeson(site Site) error {
 	srcPath := rp.sourcePath(site.GetArtifactsDir())
 	args := []string{"setup"}
 	args = append(args, rp.PackageSource.BuildArguments...)
-	args = append(args, fmt.Sprintf("--prefix=%s/.local", xdg.Home))
+	args = append(args, fmt.Sprintf("--prefix=%s", site.GetPrefix()))
 	if site.GetPkgConfigDir() != "" {
 		args = append(args, fmt.Sprintf("--pkg-config-path=%s", site.GetPkgConfigDir()))
 	}
 	if site.GetCMakeDir() != "" {
 		args = append(args, fmt.Sprintf("--cmake-prefix-path=%s", site.GetCMakeDir()))
 	}
+	if _, err := os.Stat(filepath.Join(srcPath, "build", "meson-private")); err == nil {
+		// e.g. when rebuilding against a new rizin
+		args = append(args, "--reconfigure")
+	}
 	args = append(args, "build")
 	cmd := exec.Command("meson", args...)
 	cmd.Dir = srcPath
@@ -408,7 +517,7 @@ func (rp RizinPackage) buildCMake(site Site) error {
 	srcPath := rp.sourcePath(site.GetArtifactsDir())
 	args := []string{}
 	args = append(args, rp.PackageSource.BuildArguments...)
-	args = append(args, fmt.Sprintf("-DCMAKE_INSTALL_PREFIX=%s/.local", xdg.Home))
+	args = append(args, fmt.Sprintf("-DCMAKE_INSTALL_PREFIX=%s", site.GetPrefix()))
 	if site.GetCMakeDir() != "" {
 		args = append(args, fmt.Sprintf("-DCMAKE_PREFIX_PATH=%s", site.GetCMakeDir()))
 	}
@@ -439,7 +548,13 @@ func (rp RizinPackage) installMeson(site Site) ([]string, error) {
 		return nil, err
 	}
 
-	cmd = exec.Command("meson", "introspect", "--installed", "build")
+	return mesonInstalledFiles(srcPath)
+}
+
+// mesonInstalledFiles returns the files installed by the meson build in
+// srcPath, which are known as soon as the build is configured.
+func mesonInstalledFiles(srcPath string) ([]string, error) {
+	cmd := exec.Command("meson", "introspect", "--installed", "build")
 	cmd.Dir = srcPath
 	cmd.Stderr = log.Writer()
 	out, err := cmd.Output()
@@ -459,17 +574,42 @@ func (rp RizinPackage) installMeson(site Site) ([]string, error) {
 	return installed_files, nil
 }
 
-func (rp RizinPackage) installCMake(site Site) ([]string, error) {
+// errStagingUnsupported is returned by stageCMake where cmake builds cannot
+// be installed in a staging directory
+var errStagingUnsupported = fmt.Errorf("staged installs are not supported")
+
+// stageCMake installs the cmake build in a new staging directory, with
+// DESTDIR, and returns the directory together with the files the build
+// installs, which are listed relative to the staging directory.
+func (rp RizinPackage) stageCMake(site Site) (string, []string, error) {
+	if runtime.GOOS == "windows" {
+		// DESTDIR cannot be prepended to paths with a drive letter
+		return "", nil, errStagingUnsupported
+	}
+
 	srcPath := rp.sourcePath(site.GetArtifactsDir())
+	stagingDir, err := os.MkdirTemp("", "rz-pm-staging")
+	if err != nil {
+		return "", nil, err
+	}
+
 	cmd := exec.Command("cmake", "--install", "build")
 	cmd.Dir = srcPath
+	cmd.Env = append(os.Environ(), "DESTDIR="+stagingDir)
 	cmd.Stdout = log.Writer()
 	cmd.Stderr = log.Writer()
-	if err := runCommandWithDotProgress(fmt.Sprintf("Installing %s...", rp.PackageName), cmd); err != nil {
-		return nil, err
+	if err := runCommandWithDotProgress(fmt.Sprintf("Staging %s...", rp.PackageName), cmd); err != nil {
+		return stagingDir, nil, err
 	}
 
-	file, err := os.Open(filepath.Join(srcPath, "build", "install_manifest.txt"))
+	files, err := readInstallManifest(filepath.Join(srcPath, "build", "install_manifest.txt"), stagingDir)
+	return stagingDir, files, err
+}
+
+// readInstallManifest reads the files listed in a cmake install manifest,
+// removing the DESTDIR they were installed in, if any.
+func readInstallManifest(path string, destDir string) ([]string, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -478,7 +618,11 @@ func (rp RizinPackage) installCMake(site Site) ([]string, error) {
 	scanner := bufio.NewScanner(file)
 	var lines []string
 	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+		line := scanner.Text()
+		if destDir != "" && isWithinDir(destDir, line) {
+			line = string(filepath.Separator) + strings.TrimPrefix(strings.TrimPrefix(line, destDir), string(filepath.Separator))
+		}
+		lines = append(lines, line)
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
@@ -486,6 +630,60 @@ func (rp RizinPackage) installCMake(site Site) ([]string, error) {
 	return lines, nil
 }
 
+// installStagedFiles copies the files installed in stagingDir to their
+// place, replacing the files already there.
+func installStagedFiles(stagingDir string, files []string) error {
+	for _, f := range files {
+		src := filepath.Join(stagingDir, f)
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			return err
+		}
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			var link string
+			link, err = os.Readlink(src)
+			if err == nil {
+				err = os.Symlink(link, f)
+			}
+		} else {
+			err = copyFile(src, f, fi.Mode().Perm())
+		}
+		if err != nil {
+			return fmt.Errorf("could not install %s: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// checkPlannedFiles checks that the files the package is going to install,
+// listed with listErr, do not belong to other packages. When they could not
+// be listed the installation is only allowed if forced.
+func (rp RizinPackage) checkPlannedFiles(site Site, planned []string, listErr error) error {
+	if listErr != nil {
+		return checkUnknownFiles(rp.PackageName, listErr, forceInstall(site))
+	}
+	return site.CheckFileConflicts(rp.PackageName, planned)
+}
+
+func (rp RizinPackage) installCMake(site Site) ([]string, error) {
+	srcPath := rp.sourcePath(site.GetArtifactsDir())
+	cmd := exec.Command("cmake", "--install", "build")
+	cmd.Dir = srcPath
+	cmd.Stdout = log.Writer()
+	cmd.Stderr = log.Writer()
+	if err := runCommandWithDotProgress(fmt.Sprintf("Installing %s...", rp.PackageName), cmd); err != nil {
+		return nil, err
+	}
+
+	return readInstallManifest(filepath.Join(srcPath, "build", "install_manifest.txt"), "")
+}
+
 func (rp RizinPackage) uninstallMeson(site Site) error {
 	srcPath := rp.sourcePath(site.GetArtifactsDir())
 	cmd := exec.Command("ninja", "uninstall", "-C", "build")
@@ -566,12 +764,39 @@ func (rp RizinPackage) Install(site Site) ([]string, error) {
 		return []string{}, err
 	}
 
+	srcPath := rp.sourcePath(site.GetArtifactsDir())
 	var installed_files []string
 	switch rp.PackageSource.BuildSystem {
 	case Meson:
+		planned, listErr := mesonInstalledFiles(srcPath)
+		if err := rp.checkPlannedFiles(site, planned, listErr); err != nil {
+			return []string{}, err
+		}
 		installed_files, err = rp.installMeson(site)
 	case CMake:
-		installed_files, err = rp.installCMake(site)
+		// cmake only lists the files it installs once they are installed
+		stagingDir, planned, stageErr := rp.stageCMake(site)
+		if stagingDir != "" {
+			defer os.RemoveAll(stagingDir)
+		}
+		switch {
+		case errors.Is(stageErr, errStagingUnsupported):
+			// the files are only known, and checked, after the install
+			installed_files, err = rp.installCMake(site)
+			if err == nil {
+				if conflictErr := site.CheckFileConflicts(rp.PackageName, installed_files); conflictErr != nil {
+					err = fmt.Errorf("package %s could only be checked once installed: %w", rp.PackageName, conflictErr)
+				}
+			}
+		case stageErr != nil:
+			return []string{}, stageErr
+		default:
+			if err := site.CheckFileConflicts(rp.PackageName, planned); err != nil {
+				return []string{}, err
+			}
+			fmt.Printf("Installing %s...\n", rp.PackageName)
+			installed_files, err = planned, installStagedFiles(stagingDir, planned)
+		}
 	default:
 		log.Printf("BuildSystem %s is not supported yet.", rp.PackageSource.BuildSystem)
 		err = fmt.Errorf("unsupported build system")
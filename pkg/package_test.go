@@ -81,6 +81,7 @@ type FakeSite struct {
 	ArtifactsDir string
 	PkgConfigDir string
 	CMakeDir     string
+	Prefix       string
 }
 
 func (s FakeSite) GetInstalledPackage(string) (InstalledPackage, error) {
@@ -93,14 +94,21 @@ func (s FakeSite) GetPackage(string) (Package, error)                  { return
 func (s FakeSite) GetPackageFromFile(filename string) (Package, error) { return RizinPackage{}, nil }
 func (s FakeSite) GetBaseDir() string                                  { return "" }
 func (s FakeSite) RizinVersion() string                                { return "0.5.2" }
+func (s FakeSite) RizinBinary() string                                 { return defaultRizin }
 func (s FakeSite) GetArtifactsDir() string                             { return s.ArtifactsDir }
 func (s FakeSite) GetPkgConfigDir() string                             { return s.PkgConfigDir }
 func (s FakeSite) GetCMakeDir() string                                 { return s.CMakeDir }
-func (s FakeSite) InstallPackage(Package) error                        { return nil }
+func (s FakeSite) GetPrefix() string                                   { return s.Prefix }
+func (s FakeSite) InstallPackage(Package, InstallOptions) error        { return nil }
 func (s FakeSite) UninstallPackage(Package) error                      { return nil }
 func (s FakeSite) CleanPackage(Package) error                          { return nil }
 func (s FakeSite) Remove() error                                       { return nil }
 func (s FakeSite) Close() error                                        { return nil }
+func (s FakeSite) SearchPackages(string, SearchFilter) ([]SearchResult, error) {
+	return []SearchResult{}, nil
+}
+func (s FakeSite) DatabaseChanges() (DatabaseChanges, error) { return DatabaseChanges{}, nil }
+func (s FakeSite) CheckFileConflicts(string, []string) error { return nil }
 
 func newBuildTestSite(t *testing.T, artifactsDir string) FakeSite {
 	t.Helper()
@@ -115,8 +123,8 @@ func newBuildTestSite(t *testing.T, artifactsDir string) FakeSite {
 		}
 	}
 
-	pkgConfigDir, pkgConfigErr := getPkgConfigPath()
-	cmakeDir, cmakeErr := getCMakePath()
+	pkgConfigDir, pkgConfigErr := getPkgConfigPath(defaultRizin)
+	cmakeDir, cmakeErr := getCMakePath(defaultRizin)
 	if pkgConfigErr != nil && cmakeErr != nil {
 		t.Skipf("rizin development files are required for build/install package tests: pkg-config path error: %v, cmake path error: %v", pkgConfigErr, cmakeErr)
 	}
@@ -124,10 +132,14 @@ func newBuildTestSite(t *testing.T, artifactsDir string) FakeSite {
 		t.Skip("rizin development files are required for build/install package tests")
 	}
 
+	prefix, err := resolvePrefix(PrefixHome, "", "")
+	require.NoError(t, err, "default prefix should be resolved")
+
 	return FakeSite{
 		ArtifactsDir: artifactsDir,
 		PkgConfigDir: pkgConfigDir,
 		CMakeDir:     cmakeDir,
+		Prefix:       prefix,
 	}
 }
 
@@ -572,3 +584,33 @@ func TestDownloadTarRejectsPathTraversal(t *testing.T) {
 	_, err = os.Stat(escapedPath)
 	assert.True(t, os.IsNotExist(err), "path traversal should not create files outside the package directory")
 }
+
+func TestInstallStagedFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("staged installs are not supported on windows")
+	}
+	stagingDir := t.TempDir()
+	prefix := t.TempDir()
+	plugin := filepath.Join(prefix, "lib", "rizin", "plugins", "plugin.so")
+	link := filepath.Join(prefix, "lib", "rizin", "plugins", "link.so")
+	require.NoError(t, os.MkdirAll(filepath.Join(stagingDir, filepath.Dir(plugin)), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(stagingDir, plugin), []byte("plugin"), 0755))
+	require.NoError(t, os.Symlink("plugin.so", filepath.Join(stagingDir, link)))
+	manifest := filepath.Join(t.TempDir(), "install_manifest.txt")
+	require.NoError(t, os.WriteFile(manifest, []byte(filepath.Join(stagingDir, plugin)+"\n"+filepath.Join(stagingDir, link)), 0644))
+
+	files, err := readInstallManifest(manifest, stagingDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{plugin, link}, files, "the staging directory should be removed")
+
+	require.NoError(t, installStagedFiles(stagingDir, files))
+	content, err := os.ReadFile(plugin)
+	require.NoError(t, err)
+	assert.Equal(t, "plugin", string(content))
+	fi, err := os.Stat(plugin)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	target, err := os.Readlink(link)
+	require.NoError(t, err)
+	assert.Equal(t, "plugin.so", target)
+}
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// RebuildOptions changes how installed packages are rebuilt
+type RebuildOptions struct {
+	// Upgrade rebuilds the given package even when its version or source
+	// differs from the installed one, e.g. after the database changed.
+	Upgrade bool
+}
+
+// ListPackagesToRebuild returns the installed packages built against an
+// older rizin major.minor version than the current one.
+func (s *RizinSite) ListPackagesToRebuild() []InstalledPackage {
+	minorVersion := GetMajorMinorVersion(s.rizinVersion)
+	packages := []InstalledPackage{}
+	for _, p := range s.installedPackages {
+		if p.RizinVersion != nil && isNewerVersion(minorVersion, *p.RizinVersion) {
+			packages = append(packages, p)
+		}
+	}
+	return packages
+}
+
+// rebuiltPackage returns pkg pinned to the git commit of the installed
+// package, or an error describing how pkg differs from the installed release.
+// What was not recorded at install time, e.g. by older versions of rz-pm, is
+// taken from pkg.
+func rebuiltPackage(installed InstalledPackage, pkg Package) (Package, error) {
+	if installed.InstalledVersion == "" {
+		warnf("the installed version of package %s is unknown, rebuilding %s", pkg.Name(), pkg.Version())
+	} else if pkg.Version() != installed.InstalledVersion {
+		return nil, fmt.Errorf("package %s %s is installed, not %s", pkg.Name(), installed.InstalledVersion, pkg.Version())
+	}
+
+	src := installed.InstalledSource
+	source := pkg.Source()
+	switch {
+	case src == nil:
+		if source.URL != "" {
+			warnf("the source of package %s is unknown, rebuilding it from %s", pkg.Name(), redactURL(source.URL))
+		}
+		return pkg, nil
+	case redactURL(source.URL) != src.URL:
+		return nil, fmt.Errorf("package %s was downloaded from %s, not %s", pkg.Name(), src.URL, redactURL(source.URL))
+	case source.Hash != src.Hash:
+		return nil, fmt.Errorf("package %s was installed from an archive with hash %q, not %q", pkg.Name(), src.Hash, source.Hash)
+	}
+
+	rp, ok := pkg.(RizinPackage)
+	if !ok || !rp.isGitRepo() {
+		return pkg, nil
+	}
+	switch {
+	case src.Commit == "":
+		warnf("the git commit of package %s is unknown, rebuilding the one in the database", pkg.Name())
+		return pkg, nil
+	case source.Commit != "" && source.Commit != src.Commit:
+		return nil, fmt.Errorf("package %s was built from commit %s, not %s", pkg.Name(), src.Commit, source.Commit)
+	}
+	source.Commit = src.Commit
+	rp.PackageSource = &source
+	return rp, nil
+}
+
+// RebuildPackage builds an installed package again against the current rizin
+// and reinstalls it over the old build, which is restored if that fails,
+// removing the files the new build does not install. The installed release
+// is rebuilt, at the same version and from the same source: when pkg differs
+// from it, e.g. because the database was updated, RebuildPackage fails
+// unless opts.Upgrade is set.
+func (s *RizinSite) RebuildPackage(pkg Package, opts RebuildOptions) (err error) {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	defer s.recordHistory(OperationRebuild, pkg.Name(), pkg.Version(), &err)
+	old, err := s.GetInstalledPackage(pkg.Name())
+	if err != nil {
+		return fmt.Errorf("package %s not installed", pkg.Name())
+	}
+	if !opts.Upgrade {
+		pkg, err = rebuiltPackage(old, pkg)
+		if err != nil {
+			return fmt.Errorf("%w, use --upgrade to rebuild it anyway", err)
+		}
+	}
+	// NOTE: the files of packages installed by v0.1.9 are unknown, they are
+	// overwritten by the new build
+	if old.InstalledFiles != nil {
+		if err := s.saveRollback(old); err != nil {
+			return fmt.Errorf("could not save %s %s to restore it if the rebuild fails: %w", old.Name(), old.Version(), err)
+		}
+	}
+
+	files, err := pkg.Install(installContext{RizinSite: s})
+	if err != nil {
+		if old.InstalledFiles == nil {
+			return err
+		}
+		if restoreErr := s.restoreRollback(old); restoreErr != nil {
+			return fmt.Errorf("could not install the new build of %s: %w, and the old one could not be restored: %v", pkg.Name(), err, restoreErr)
+		}
+		return fmt.Errorf("could not install the new build of %s, the old one is still installed: %w", pkg.Name(), err)
+	}
+	s.takeOverFiles(pkg.Name(), files)
+
+	s.removeStaleFiles(old, files)
+
+	ip := s.newInstalledPackage(pkg, files)
+	ip.Broken = s.checkInstalledPlugins(pkg.Name(), files)
+	s.replaceInstalledPackage(ip)
+	s.dropDisabledPlugins(pkg.Name())
+	installedFilePath := filepath.Join(s.Path, installedFile)
+	return updateInstalledPackages(installedFilePath, s.installedPackages)
+}
+
+// removeStaleFiles removes the files of the old installation of a package
+// that its new installation, which installed files, does not install.
+func (s *RizinSite) removeStaleFiles(old InstalledPackage, files []string) {
+	current := map[string]bool{}
+	for _, f := range files {
+		current[f] = true
+	}
+	s.removeInstalledFiles(old.keepFiles(func(f string) bool { return !current[f] }))
+}
@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upgradeTestRizin replaces the rizin of site with a fake rizin of version
+// and returns the reopened site
+func upgradeTestRizin(t *testing.T, site *RizinSite, version string) *RizinSite {
+	require.NoError(t, site.Close())
+	writeFakeRizin(t, filepath.Dir(site.RizinBinary()), version)
+	reopened, err := InitSiteWithOptions(site.Path, SiteOptions{Rizin: site.RizinBinary()})
+	require.NoError(t, err)
+	t.Cleanup(func() { reopened.Close() })
+	return reopened.(*RizinSite)
+}
+
+func TestRebuildPackage(t *testing.T) {
+	site := newTestSite(t)
+
+	pluginsDir := filepath.Join(site.GetPrefix(), "lib", "rizin", "plugins")
+	plugin := filepath.Join(pluginsDir, "plugin.so")
+	dropped := filepath.Join(pluginsDir, "dropped.so")
+	require.NoError(t, site.InstallPackage(versionedPackage{filesPackage{FakePackage{myName: "plugin"}, []string{plugin, dropped}}, "1.0"}, InstallOptions{}))
+	assert.Empty(t, site.ListPackagesToRebuild())
+
+	site = upgradeTestRizin(t, site, "0.9.0")
+	toRebuild := site.ListPackagesToRebuild()
+	require.Len(t, toRebuild, 1)
+	assert.Equal(t, "plugin", toRebuild[0].Name())
+
+	require.NoError(t, site.RebuildPackage(versionedPackage{filesPackage{FakePackage{myName: "plugin"}, []string{plugin}}, "1.0"}, RebuildOptions{}))
+	assert.Empty(t, site.ListPackagesToRebuild())
+	installed, err := site.GetInstalledPackage("plugin")
+	require.NoError(t, err)
+	assert.Equal(t, []string{plugin}, installed.files())
+	_, err = os.Stat(dropped)
+	assert.True(t, os.IsNotExist(err), "files not installed anymore should be removed")
+}
+
+func TestFailedRebuildRestoresPackage(t *testing.T) {
+	site := newTestSite(t)
+
+	plugin := filepath.Join(site.GetPrefix(), "lib", "rizin", "plugins", "plugin.so")
+	link := filepath.Join(site.GetPrefix(), "lib", "rizin", "plugins", "link.so")
+	require.NoError(t, site.InstallPackage(linkedPackage{versionedPackage{filesPackage{FakePackage{myName: "plugin"}, []string{plugin}}, "1.0"}, link}, InstallOptions{}))
+
+	err := site.RebuildPackage(failingPackage{versionedPackage{filesPackage{FakePackage{myName: "plugin"}, []string{plugin}}, "1.0"}}, RebuildOptions{})
+	assert.ErrorContains(t, err, "the old one is still installed")
+	content, err := os.ReadFile(plugin)
+	require.NoError(t, err)
+	assert.Equal(t, "version 1.0", string(content))
+	installed, err := site.GetInstalledPackage("plugin")
+	require.NoError(t, err)
+	assert.Equal(t, []string{plugin, link}, installed.files())
+}
+
+func TestRebuildKeepsInstalledRelease(t *testing.T) {
+	site := newTestSite(t)
+
+	plugin := filepath.Join(site.GetPrefix(), "lib", "rizin", "plugins", "plugin.so")
+	require.NoError(t, site.InstallPackage(versionedPackage{filesPackage{FakePackage{myName: "plugin"}, []string{plugin}}, "1.0"}, InstallOptions{}))
+
+	newer := versionedPackage{filesPackage{FakePackage{myName: "plugin"}, []string{plugin}}, "2.0"}
+	err := site.RebuildPackage(newer, RebuildOptions{})
+	assert.ErrorContains(t, err, "package plugin 1.0 is installed, not 2.0")
+	installed, err := site.GetInstalledPackage("plugin")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", installed.Version())
+
+	require.NoError(t, site.RebuildPackage(newer, RebuildOptions{Upgrade: true}))
+	installed, err = site.GetInstalledPackage("plugin")
+	require.NoError(t, err)
+	assert.Equal(t, "2.0", installed.Version())
+}
+
+func TestRebuiltPackage(t *testing.T) {
+	installed := InstalledPackage{
+		InstalledName:    "plugin",
+		InstalledVersion: "1.0",
+		InstalledSource:  &SourceRevision{URL: "https://example.com/plugin.git", Commit: "abc"},
+	}
+	rp := RizinPackage{
+		PackageName:    "plugin",
+		PackageVersion: "1.0",
+		PackageSource:  &RizinPackageSource{URL: "https://example.com/plugin.git"},
+	}
+
+	p, err := rebuiltPackage(installed, rp)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", p.Source().Commit, "the installed commit should be rebuilt")
+	assert.Empty(t, rp.Source().Commit, "the database package should not change")
+
+	rp.PackageSource = &RizinPackageSource{URL: "https://example.com/fork.git"}
+	_, err = rebuiltPackage(installed, rp)
+	assert.ErrorContains(t, err, "was downloaded from https://example.com/plugin.git")
+
+	installed.InstalledSource = &SourceRevision{URL: "https://example.com/plugin.tar.gz", Hash: "old"}
+	rp.PackageSource = &RizinPackageSource{URL: "https://example.com/plugin.tar.gz", Hash: "new"}
+	_, err = rebuiltPackage(installed, rp)
+	assert.ErrorContains(t, err, "hash")
+
+	// installed before the version and the source were recorded
+	p, err = rebuiltPackage(InstalledPackage{InstalledName: "plugin"}, rp)
+	require.NoError(t, err)
+	assert.Equal(t, rp, p, "the database release should be rebuilt")
+}
+
+func TestListPackagesToRebuild(t *testing.T) {
+	older, current, newer := "0.7", "0.8", "0.9"
+	site := &RizinSite{rizinVersion: "0.8.1", installedPackages: []InstalledPackage{
+		{InstalledName: "older", RizinVersion: &older},
+		{InstalledName: "current", RizinVersion: &current},
+		{InstalledName: "newer", RizinVersion: &newer},
+		{InstalledName: "unknown"},
+	}}
+
+	toRebuild := site.ListPackagesToRebuild()
+	require.Len(t, toRebuild, 1)
+	assert.Equal(t, "older", toRebuild[0].Name())
+}
@@ -0,0 +1,307 @@
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// rollbackDir holds, for each package, the files and the installed state
+// entry of its previous installation
+const rollbackDir string = "rollback"
+
+const restoringSuffix string = ".restoring"
+
+func (s *RizinSite) rollbackPaths(name string) (archive string, entry string) {
+	dir := filepath.Join(s.Path, rollbackDir)
+	return filepath.Join(dir, name+".tar.gz"), filepath.Join(dir, name+".json")
+}
+
+// saveRollback archives the files installed by ip, together with ip itself,
+// so that they can be restored by RollbackPackage. Only the last
+// installation of each package is kept.
+func (s *RizinSite) saveRollback(ip InstalledPackage) error {
+	archivePath, entryPath := s.rollbackPaths(ip.Name())
+	if err := s.archiveInstalledPackage(ip, archivePath); err != nil {
+		return err
+	}
+
+	// the archive has the plugins in place
+	ip.Disabled = false
+	by, err := json.MarshalIndent(ip, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(entryPath, by, 0644, false)
+}
+
+// restoreRollback puts back the files of ip saved by saveRollback, over
+// whatever was installed since
+func (s *RizinSite) restoreRollback(ip InstalledPackage) error {
+	archivePath, _ := s.rollbackPaths(ip.Name())
+	return s.restoreArchive(ip, archivePath)
+}
+
+// restoreArchive extracts the archive of the files of ip in the install
+// prefix. The plugins of a disabled package stay where they are kept.
+func (s *RizinSite) restoreArchive(ip InstalledPackage, archivePath string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := extractFilesArchive(f, s.GetPrefix()); err != nil {
+		return err
+	}
+	for plugin := range s.heldPlugins(ip) {
+		if err := os.Remove(plugin); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveInstalledPackage writes an archive of the files installed by ip to
+// archivePath, replacing it only once it is complete
+func (s *RizinSite) archiveInstalledPackage(ip InstalledPackage, archivePath string) error {
+	if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(archivePath), "."+filepath.Base(archivePath)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeFilesArchive(tmp, s.GetPrefix(), ip.files(), s.heldPlugins(ip))
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp.Name(), archivePath)
+}
+
+// writeFilesArchive writes a tar.gz archive of the given files to w, with
+// paths relative to prefix. Files outside of prefix or missing are skipped.
+// held maps the files that are not at their path, like the plugins of
+// disabled packages, to where they are kept.
+func writeFilesArchive(w io.Writer, prefix string, files []string, held map[string]string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		if !isWithinDir(prefix, file) {
+			warnf("not archiving %s, it is outside of the install prefix %s", file, prefix)
+			continue
+		}
+		src := file
+		if h, ok := held[file]; ok {
+			src = h
+		}
+		fi, err := os.Lstat(src)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() && fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(src); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(prefix, file)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			if err := copyToArchive(tw, src); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func copyToArchive(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// extractFilesArchive extracts an archive written by writeFilesArchive in
+// prefix
+func extractFilesArchive(r io.Reader, prefix string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		target, err := secureJoin(prefix, filepath.FromSlash(header.Name))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		// replace whatever is there, which might be a read-only file
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, target)
+		case tar.TypeReg:
+			err = extractArchiveFile(tr, target, header.FileInfo().Mode())
+		default:
+			err = fmt.Errorf("unexpected entry %s in archive", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractArchiveFile(r io.Reader, path string, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	// not affected by the umask, unlike OpenFile
+	return os.Chmod(path, mode.Perm())
+}
+
+// RollbackPackage restores the previous installation of the named package,
+// saved when it was last upgraded or rebuilt, without building it. The
+// current installation, if any, is saved in its place so that rolling back
+// twice goes back to it. The previous installation is extracted over the
+// current one, which is restored if that fails.
+func (s *RizinSite) RollbackPackage(name string) (err error) {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	archivePath, entryPath := s.rollbackPaths(name)
+	by, err := os.ReadFile(entryPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no previous installation of %s to roll back to", name)
+	} else if err != nil {
+		return err
+	}
+	var previous InstalledPackage
+	if err := json.Unmarshal(by, &previous); err != nil {
+		return fmt.Errorf("invalid rollback entry for %s: %w", name, err)
+	}
+	defer func() { s.recordHistory(OperationRollback, name, previous.Version(), &err) }()
+	if err := s.CheckFileConflicts(name, previous.files()); err != nil {
+		return err
+	}
+
+	// the current installation takes the place of the previous one, which
+	// is put back if anything fails
+	restoringPath := archivePath + restoringSuffix
+	if err := os.Rename(archivePath, restoringPath); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if renameErr := os.Rename(restoringPath, archivePath); renameErr != nil {
+			warnf("could not put back %s: %v", archivePath, renameErr)
+		} else if writeErr := writeFileAtomic(entryPath, by, 0644, false); writeErr != nil {
+			warnf("could not put back %s: %v", entryPath, writeErr)
+		}
+	}()
+
+	current, err := s.GetInstalledPackage(name)
+	installed := err == nil
+	if installed {
+		if err := s.saveRollback(current); err != nil {
+			return fmt.Errorf("could not save the current installation of %s: %w", name, err)
+		}
+	}
+
+	f, err := os.Open(restoringPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := extractFilesArchive(f, s.GetPrefix()); err != nil {
+		if installed {
+			if restoreErr := s.restoreRollback(current); restoreErr != nil {
+				return fmt.Errorf("could not restore the files of %s: %w, and %s could not be restored: %v", name, err, current.Version(), restoreErr)
+			}
+			return fmt.Errorf("could not restore the files of %s, %s is still installed: %w", name, current.Version(), err)
+		}
+		return fmt.Errorf("could not restore the files of %s: %w", name, err)
+	}
+
+	if installed {
+		fmt.Printf("Removing the files of %s %s...\n", name, current.Version())
+		s.removeStaleFiles(current, previous.files())
+		s.dropDisabledPlugins(name)
+		s.replaceInstalledPackage(previous)
+	} else {
+		s.installedPackages = append(s.installedPackages, previous)
+	}
+	installedFilePath := filepath.Join(s.Path, installedFile)
+	if err := updateInstalledPackages(installedFilePath, s.installedPackages); err != nil {
+		return err
+	}
+
+	if !installed {
+		if err := os.Remove(entryPath); err != nil {
+			warnf("could not remove %s: %v", entryPath, err)
+		}
+	}
+	if err := os.Remove(restoringPath); err != nil {
+		warnf("could not remove %s: %v", restoringPath, err)
+	}
+	fmt.Printf("Package %s rolled back to version %s.\n", name, previous.Version())
+	return nil
+}
@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/go-version"
+)
+
+// SearchFilter restricts the packages returned by Site.SearchPackages.
+type SearchFilter int
+
+const (
+	SearchAll SearchFilter = iota
+	SearchInstalled
+	SearchNotInstalled
+	SearchUpgradable
+)
+
+const (
+	SearchFieldName        = "name"
+	SearchFieldTags        = "tags"
+	SearchFieldSummary     = "summary"
+	SearchFieldDescription = "description"
+)
+
+// SearchMatch is a part of a package field matching the search query. Start
+// and End are byte offsets in the text returned by SearchFieldText.
+type SearchMatch struct {
+	Field string `json:"field"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+type SearchResult struct {
+	Package Package
+	Score   int
+	Matches []SearchMatch
+}
+
+var searchFieldWeights = []struct {
+	field  string
+	weight int
+}{
+	{SearchFieldName, 8},
+	{SearchFieldTags, 4},
+	{SearchFieldSummary, 2},
+	{SearchFieldDescription, 1},
+}
+
+// match qualities, multiplied by the field weight to get the score of a term
+const (
+	qualityTypo2 = 1
+	qualityTypo1 = 2
+	qualityInfix = 3
+	qualityWord  = 4
+	qualityExact = 6
+)
+
+// SearchFieldText returns the text of a package field as used for matching.
+func SearchFieldText(p Package, field string) string {
+	switch field {
+	case SearchFieldName:
+		return p.Name()
+	case SearchFieldTags:
+		return strings.Join(p.Tags(), ", ")
+	case SearchFieldSummary:
+		return p.Summary()
+	case SearchFieldDescription:
+		return p.Description()
+	}
+	return ""
+}
+
+type searchWord struct {
+	text  string
+	start int
+	end   int
+}
+
+func splitSearchWords(s string) []searchWord {
+	words := []searchWord{}
+	start := -1
+	for i, r := range s {
+		isWordChar := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordChar && start == -1 {
+			start = i
+		} else if !isWordChar && start != -1 {
+			words = append(words, searchWord{s[start:i], start, i})
+			start = -1
+		}
+	}
+	if start != -1 {
+		words = append(words, searchWord{s[start:], start, len(s)})
+	}
+	return words
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// maxTypos is the number of edits tolerated for a query term of length n
+func maxTypos(n int) int {
+	switch {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// foldCase lowercases text, returning for each byte offset of the result the
+// offset of the character it comes from in text, as some characters change
+// length when lowercased
+func foldCase(text string) (string, []int) {
+	var sb strings.Builder
+	offsets := make([]int, 0, len(text)+1)
+	for i, r := range text {
+		lower := string(unicode.ToLower(r))
+		sb.WriteString(lower)
+		for j := 0; j < len(lower); j++ {
+			offsets = append(offsets, i)
+		}
+	}
+	offsets = append(offsets, len(text))
+	return sb.String(), offsets
+}
+
+// originalMatch maps a match in the text lowercased by foldCase back to the
+// original text
+func originalMatch(m SearchMatch, offsets []int) SearchMatch {
+	end := m.End
+	// do not cut a character in half
+	for end > 0 && end < len(offsets)-1 && offsets[end] == offsets[end-1] {
+		end++
+	}
+	return SearchMatch{Field: m.Field, Start: offsets[m.Start], End: offsets[end]}
+}
+
+// matchTerm finds the best match of a lowercase term in text
+func matchTerm(text string, term string) (int, SearchMatch, bool) {
+	lower, offsets := foldCase(text)
+	quality, match, ok := matchFoldedTerm(lower, term)
+	if !ok {
+		return 0, SearchMatch{}, false
+	}
+	return quality, originalMatch(match, offsets), true
+}
+
+func matchFoldedTerm(lower string, term string) (int, SearchMatch, bool) {
+	if lower == term {
+		return qualityExact, SearchMatch{Start: 0, End: len(lower)}, true
+	}
+
+	words := splitSearchWords(lower)
+	for _, w := range words {
+		if strings.HasPrefix(w.text, term) {
+			return qualityWord, SearchMatch{Start: w.start, End: w.start + len(term)}, true
+		}
+	}
+	if idx := strings.Index(lower, term); idx != -1 {
+		return qualityInfix, SearchMatch{Start: idx, End: idx + len(term)}, true
+	}
+
+	allowed := maxTypos(len([]rune(term)))
+	best := allowed + 1
+	var bestMatch SearchMatch
+	for _, w := range words {
+		d := levenshtein(w.text, term)
+		end := w.end
+		// also tolerate typos in a prefix of a longer word
+		if r := []rune(w.text); len(r) > len([]rune(term)) {
+			prefix := string(r[:len([]rune(term))])
+			if pd := levenshtein(prefix, term); pd < d {
+				d = pd
+				end = w.start + len(prefix)
+			}
+		}
+		if d < best {
+			best = d
+			bestMatch = SearchMatch{Start: w.start, End: end}
+		}
+	}
+	switch {
+	case best == 0:
+		return qualityWord, bestMatch, true
+	case best == 1 && best <= allowed:
+		return qualityTypo1, bestMatch, true
+	case best == 2 && best <= allowed:
+		return qualityTypo2, bestMatch, true
+	}
+	return 0, SearchMatch{}, false
+}
+
+// scorePackage returns the score of p for the given query terms. Every term
+// has to match at least one field, otherwise the package does not match.
+func scorePackage(p Package, terms []string) (int, []SearchMatch, bool) {
+	score := 0
+	matches := []SearchMatch{}
+	for _, term := range terms {
+		bestScore := 0
+		for _, f := range searchFieldWeights {
+			quality, match, ok := matchTerm(SearchFieldText(p, f.field), term)
+			if !ok {
+				continue
+			}
+			match.Field = f.field
+			matches = append(matches, match)
+			if quality*f.weight > bestScore {
+				bestScore = quality * f.weight
+			}
+		}
+		if bestScore == 0 {
+			return 0, nil, false
+		}
+		score += bestScore
+	}
+	return score, matches, true
+}
+
+// searchPackages ranks the packages matching query, best match first
+func searchPackages(packages []Package, query string) []SearchResult {
+	terms := strings.Fields(strings.ToLower(query))
+	results := []SearchResult{}
+	if len(terms) == 0 {
+		return results
+	}
+
+	for _, p := range packages {
+		score, matches, ok := scorePackage(p, terms)
+		if ok {
+			results = append(results, SearchResult{Package: p, Score: score, Matches: matches})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Package.Name() < results[j].Package.Name()
+	})
+	return results
+}
+
+// isNewerVersion reports whether available is a newer version than installed.
+// Versions that cannot be compared, e.g. "dev", are never newer.
+func isNewerVersion(available string, installed string) bool {
+	if available == "" || installed == "" || available == installed {
+		return false
+	}
+
+	av, err := version.NewVersion(available)
+	if err != nil {
+		return false
+	}
+	iv, err := version.NewVersion(installed)
+	if err != nil {
+		return false
+	}
+	return av.GreaterThan(iv)
+}
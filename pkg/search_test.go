@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func searchTestPackages() []Package {
+	return []Package{
+		RizinPackage{
+			PackageName:        "jsdec",
+			PackageSummary:     "Converts asm to pseudo-C code",
+			PackageDescription: "Decompiler written in JavaScript",
+			PackageTags:        []string{"decompiler"},
+		},
+		RizinPackage{
+			PackageName:        "rz-ghidra",
+			PackageSummary:     "Ghidra decompiler integration",
+			PackageDescription: "Deep integration of the Ghidra decompiler",
+			PackageTags:        []string{"decompiler", "ghidra"},
+		},
+		RizinPackage{
+			PackageName:    "rz-keystone",
+			PackageSummary: "Keystone assembler plugins",
+		},
+	}
+}
+
+func searchResultNames(results []SearchResult) []string {
+	names := []string{}
+	for _, r := range results {
+		names = append(names, r.Package.Name())
+	}
+	return names
+}
+
+func TestSearchPackagesRanking(t *testing.T) {
+	results := searchPackages(searchTestPackages(), "Ghidra")
+	assert.Equal(t, []string{"rz-ghidra"}, searchResultNames(results))
+
+	results = searchPackages(searchTestPackages(), "decompiler")
+	require.Len(t, results, 2)
+	assert.Equal(t, []string{"jsdec", "rz-ghidra"}, searchResultNames(results), "equal scores are sorted by name")
+
+	results = searchPackages(searchTestPackages(), "jsdec decompiler")
+	assert.Equal(t, []string{"jsdec"}, searchResultNames(results), "every term of the query has to match")
+}
+
+func TestSearchPackagesTypos(t *testing.T) {
+	results := searchPackages(searchTestPackages(), "keystnoe")
+	assert.Equal(t, []string{"rz-keystone"}, searchResultNames(results))
+
+	results = searchPackages(searchTestPackages(), "jsdek")
+	assert.Equal(t, []string{"jsdec"}, searchResultNames(results))
+
+	results = searchPackages(searchTestPackages(), "xyz")
+	assert.Empty(t, results, "short terms must not match with typos")
+}
+
+func TestSearchPackagesMatches(t *testing.T) {
+	results := searchPackages(searchTestPackages(), "ASM")
+	require.Len(t, results, 1)
+	assert.Equal(t, "jsdec", results[0].Package.Name())
+	assert.Contains(t, results[0].Matches, SearchMatch{Field: SearchFieldSummary, Start: 9, End: 12})
+
+	results = searchPackages(searchTestPackages(), "assem")
+	require.Len(t, results, 1)
+	assert.Equal(t, "rz-keystone", results[0].Package.Name())
+	assert.Contains(t, results[0].Matches, SearchMatch{Field: SearchFieldSummary, Start: 9, End: 14})
+}
+
+func TestIsNewerVersion(t *testing.T) {
+	assert.True(t, isNewerVersion("0.8.0", "0.7.0"))
+	assert.False(t, isNewerVersion("0.7.0", "0.8.0"))
+	assert.False(t, isNewerVersion("0.7.0", "0.7.0"))
+	assert.False(t, isNewerVersion("0.7.0", ""))
+	assert.False(t, isNewerVersion("dev-2", "dev-1"), "versions that cannot be compared are not newer")
+	assert.False(t, isNewerVersion("dev", "1.0"))
+	assert.False(t, isNewerVersion("1.0", "dev"))
+}
+
+func TestMatchTermFoldsCase(t *testing.T) {
+	// "İ" is longer than its lowercase form
+	text := "İstanbul Disassembler"
+	quality, match, ok := matchTerm(text, "disasm")
+	require.True(t, ok)
+	assert.Equal(t, qualityTypo1, quality)
+	assert.Equal(t, "Disass", text[match.Start:match.End])
+
+	_, match, ok = matchTerm(text, "istanbul")
+	require.True(t, ok, "matching should stay case-insensitive")
+	assert.Equal(t, "İstanbul", text[match.Start:match.End])
+}
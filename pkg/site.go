@@ -1,17 +1,16 @@
 package pkg
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"log"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
 
 	"github.com/adrg/xdg"
 )
@@ -21,6 +20,9 @@ const (
 )
 
 var ErrSiteLocked = fmt.Errorf("site directory is already locked")
+var ErrSiteShared = fmt.Errorf("site is opened for reading only")
+var ErrRizinMismatch = fmt.Errorf("rizin binary does not match the site")
+var ErrNoArtifacts = fmt.Errorf("no build artifacts")
 
 func SiteDir() string {
 	if envVar := os.Getenv(SiteDirEnvVar); envVar != "" {
@@ -32,14 +34,19 @@ func SiteDir() string {
 
 var RZPM_DB_REPO_URL string
 
+// RZPM_DB_BRANCH forces the rz-pm-db branch to use instead of the one
+// selected from the rizin version.
+var RZPM_DB_BRANCH string
+
 func init() {
 	dbURL := os.Getenv("RZPM_DB_REPO_URL")
 	if dbURL != "" {
-		log.Printf("Using custom rz-pm-db Git repo: %s\n", dbURL)
+		log.Printf("Using custom rz-pm-db Git repo: %s\n", redactURL(dbURL))
 		RZPM_DB_REPO_URL = dbURL
 	} else {
 		RZPM_DB_REPO_URL = "https://github.com/rizinorg/rz-pm-db"
 	}
+	RZPM_DB_BRANCH = os.Getenv("RZPM_DB_BRANCH")
 }
 
 type Site interface {
@@ -54,26 +61,63 @@ type Site interface {
 	GetArtifactsDir() string
 	GetPkgConfigDir() string
 	GetCMakeDir() string
-	InstallPackage(pkg Package) error
+	GetPrefix() string
+	InstallPackage(pkg Package, opts InstallOptions) error
 	UninstallPackage(pkg Package) error
 	CleanPackage(pkg Package) error
 	Remove() error
 	RizinVersion() string
+	RizinBinary() string
+	SearchPackages(query string, filter SearchFilter) ([]SearchResult, error)
+	DatabaseChanges() (DatabaseChanges, error)
+	CheckFileConflicts(pkgName string, files []string) error
+}
+
+// SiteMaintenance holds the operations that keep the installed packages of
+// a site working over time, beyond installing and uninstalling them.
+type SiteMaintenance interface {
+	VerifyPackages(names []string) (VerifyReport, error)
+	FileOwners(path string) []InstalledPackage
+	ListPackagesToRebuild() []InstalledPackage
+	RebuildPackage(pkg Package, opts RebuildOptions) error
+	ListOutdatedPackages() ([]OutdatedPackage, error)
+	UpgradePackage(pkg Package, opts InstallOptions) error
+	RollbackPackage(name string) error
+	ExportLockfile() (Lockfile, error)
+	InstallFromLockfile(lf Lockfile, opts InstallOptions) error
+	CollectGarbage(opts GCOptions) ([]ArtifactDir, error)
+	DiskUsage() ([]PackageUsage, error)
+	CheckPackages(names []string) ([]PluginCheck, error)
+	DisablePackage(name string) error
+	EnablePackage(name string) error
+	RecordGeneration(description string) (bool, error)
+	ListGenerations() ([]Generation, error)
+	SwitchGeneration(id int) error
+	DeleteGeneration(id int) error
+	History() ([]HistoryEntry, error)
+	UndoHistory(id int) error
+}
+
+// ManagedSite is a site together with its maintenance operations, as opened
+// by InitSiteWithOptions
+type ManagedSite interface {
+	Site
+	SiteMaintenance
 }
 
 type InstalledPackage struct {
-	InstalledName  string    `json:"name"`
-	InstalledFiles *[]string `json:"files"`
-	RizinVersion   *string   `json:"rizin_version"`
-}
-
-type SiteLock struct {
-	sync.Locker
-	path             string
-	locked           bool
-	mu               sync.Mutex
-	interruptSignals chan os.Signal
-	interruptCleanup chan struct{}
+	InstalledName    string    `json:"name"`
+	InstalledVersion string    `json:"version,omitempty"`
+	InstalledFiles   *[]string `json:"files"`
+	RizinVersion     *string   `json:"rizin_version"`
+	// FileInfo is the state of InstalledFiles right after the installation
+	FileInfo        []InstalledFile `json:"file_info,omitempty"`
+	InstalledSource *SourceRevision `json:"source,omitempty"`
+	// Broken is set when rizin fails to load the plugins of the package
+	Broken bool `json:"broken,omitempty"`
+	// Disabled is set when the plugins of the package are kept in the site,
+	// where rizin does not load them
+	Disabled bool `json:"disabled,omitempty"`
 }
 
 type RizinSite struct {
@@ -81,23 +125,67 @@ type RizinSite struct {
 	Database          Database
 	PkgConfigPath     string
 	CMakePath         string
+	Config            SiteConfig
 	installedPackages []InstalledPackage
 	rizinVersion      string
+	rizinPath         string
 	lock              *SiteLock
+	// undoing is the id of the history entry being undone
+	undoing int
+}
+
+// SiteOptions control how a site is opened.
+type SiteOptions struct {
+	UpdateDB bool
+	// Prefix is the install prefix of a new site: PrefixHome, PrefixSite,
+	// PrefixSystem or an absolute path. Opening an existing site with a
+	// different prefix fails.
+	Prefix string
+	// Rizin is the rizin binary to use, either a path or a name to look up
+	// in PATH. Defaults to "rizin".
+	Rizin string
+	// PerRizinSite opens a separate site, inside the requested one, when
+	// the site was created for a different rizin binary. Otherwise such a
+	// mismatch is an error.
+	PerRizinSite bool
+	// Wait blocks until other rz-pm instances release the site, instead of
+	// failing with ErrSiteLocked.
+	Wait bool
+	// DatabaseDir is the database directory of a new site, when it shares
+	// the database of another site. Defaults to the one inside the site.
+	DatabaseDir string
+	// LockMode is LockShared for read-only access to the site, which does not
+	// block other readers. The database is updated under its own lock either
+	// way.
+	LockMode LockMode
 }
 
 const dbDir string = "rz-pm-db"
 const artifactsDir string = "artifacts"
 const installedFile string = "installed"
+const rizinSitesDir string = "rizin-sites"
+
+// PerRizinSiteDir returns the site used for the rizin binary at rizinPath when
+// the site at path was created for a different rizin.
+func PerRizinSiteDir(path string, rizinPath string) string {
+	h := sha256.Sum256([]byte(rizinPath))
+	return filepath.Join(path, rizinSitesDir, hex.EncodeToString(h[:6]))
+}
 
 func InitSite(path string, updateDB bool) (Site, error) {
+	return InitSiteWithOptions(path, SiteOptions{UpdateDB: updateDB})
+}
+
+func InitSiteWithOptions(path string, opts SiteOptions) (ManagedSite, error) {
+	return initSite(path, opts)
+}
+
+func initSite(path string, opts SiteOptions) (*RizinSite, error) {
 	// create the filesystem structure
-	dbSubdir := filepath.Join(path, dbDir)
 	artifactsSubdir := filepath.Join(path, artifactsDir)
 	installedFilePath := filepath.Join(path, installedFile)
 	paths := []string{
 		path,
-		dbSubdir,
 		artifactsSubdir,
 	}
 
@@ -108,15 +196,17 @@ func InitSite(path string, updateDB bool) (Site, error) {
 	}
 
 	// lock the site directory
-	siteLock := newSiteLock(path)
-	err := siteLock.Lock()
-	if err != nil {
-		if err == ErrSiteLocked {
-			fmt.Println("Site directory is already locked, another instance of rz-pm might be running or the site directory is locked.")
-			fmt.Println("If you are sure that no other instance is running, you can remove the lock file manually.")
-			fmt.Println("Lock file is located at:", filepath.Join(path, "site.lock"))
-			return &RizinSite{}, fmt.Errorf("can't operate on site directory %s: %w", path, err)
-		}
+	siteLock := newSiteLock(path, opts.LockMode)
+	var err error
+	if opts.Wait {
+		err = siteLock.LockWait()
+	} else {
+		err = siteLock.Lock()
+	}
+	if errors.Is(err, ErrSiteLocked) {
+		return &RizinSite{}, fmt.Errorf("can't operate on site directory %s: %w", path, err)
+	} else if err != nil {
+		return &RizinSite{}, fmt.Errorf("could not lock site directory %s: %w", path, err)
 	}
 
 	cleanup := func(err error) (*RizinSite, error) {
@@ -124,27 +214,66 @@ func InitSite(path string, updateDB bool) (Site, error) {
 		return &RizinSite{}, fmt.Errorf("failed to initialize site: %w", err)
 	}
 
-	rizinVersion, err := getRizinVersion()
+	rizinPath, err := findRizin(opts.Rizin)
+	if err != nil {
+		return cleanup(err)
+	}
+
+	config, err := loadSiteConfig(path, opts, rizinPath)
+	if err != nil {
+		return cleanup(fmt.Errorf("failed to get site configuration: %w", err))
+	}
+	dbSubdir := config.Database
+	if dbSubdir == "" {
+		dbSubdir = filepath.Join(path, dbDir)
+	}
+	if err := os.MkdirAll(dbSubdir, 0755); err != nil {
+		return cleanup(fmt.Errorf("could not create %s: %w", dbSubdir, err))
+	}
+	// sites created by older versions of rz-pm are not bound to a rizin
+	if config.Rizin != "" && config.Rizin != rizinPath {
+		if !opts.PerRizinSite {
+			return cleanup(fmt.Errorf("%w: site %s was created for %s but %s was selected, use --per-rizin-site to use a separate site for each rizin", ErrRizinMismatch, path, config.Rizin, rizinPath))
+		}
+		_ = siteLock.Unlock()
+		rizinSitePath := PerRizinSiteDir(path, rizinPath)
+		log.Printf("Using site %s for %s\n", rizinSitePath, rizinPath)
+		rizinSiteOpts := opts
+		rizinSiteOpts.Rizin = rizinPath
+		rizinSiteOpts.PerRizinSite = false
+		if rizinSiteOpts.Prefix == "" {
+			rizinSiteOpts.Prefix = PrefixSite
+		}
+		_, statErr := os.Stat(filepath.Join(rizinSitePath, configFile))
+		s, err := initSite(rizinSitePath, rizinSiteOpts)
+		if err == nil && os.IsNotExist(statErr) {
+			printPerRizinSiteUsage(s)
+		}
+		return s, err
+	}
+
+	rizinVersion, err := getRizinVersion(rizinPath)
 	if err != nil {
 		return cleanup(fmt.Errorf("failed to get rizin version: %w", err))
 	}
 
-	installedPackages, err := getInstalledPackages(installedFilePath, rizinVersion)
+	// migrations of the installed state are only saved with exclusive access
+	installedPackages, err := getInstalledPackages(installedFilePath, rizinVersion, opts.LockMode == LockExclusive)
 	if err != nil {
 		return cleanup(fmt.Errorf("failed to get installed packages: %w", err))
 	}
 
-	d, err := InitDatabase(dbSubdir, rizinVersion, updateDB)
+	d, err := InitDatabase(dbSubdir, rizinVersion, opts.UpdateDB)
 	if err != nil {
 		return cleanup(fmt.Errorf("failed to initialize database: %w", err))
 	}
 
-	pkgConfigPath, err := getPkgConfigPath()
+	pkgConfigPath, err := getPkgConfigPath(rizinPath)
 	if err != nil {
 		return cleanup(fmt.Errorf("failed to get pkg-config path: %w", err))
 	}
 
-	cmakePath, err := getCMakePath()
+	cmakePath, err := getCMakePath(rizinPath)
 	if err != nil {
 		return cleanup(fmt.Errorf("failed to get CMake path: %w", err))
 	}
@@ -154,20 +283,36 @@ func InitSite(path string, updateDB bool) (Site, error) {
 		Database:          d,
 		PkgConfigPath:     pkgConfigPath,
 		CMakePath:         cmakePath,
+		Config:            config,
 		installedPackages: installedPackages,
 		rizinVersion:      rizinVersion,
+		rizinPath:         rizinPath,
 		lock:              siteLock,
 	}
 
 	return &s, nil
 }
 
+// printPerRizinSiteUsage tells how to run rizin with the plugins of the
+// per-rizin site s, which rizin does not load unless it uses the home prefix
+func printPerRizinSiteUsage(s *RizinSite) {
+	homePrefix, _ := resolvePrefix(PrefixHome, "", "")
+	if s.GetPrefix() == homePrefix {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Created site %s for %s, which installs packages in %s.\n", s.Path, s.rizinPath, s.GetPrefix())
+	fmt.Fprintf(os.Stderr, "rizin does not load plugins from there by default, run it with:\n")
+	fmt.Fprintf(os.Stderr, "  rz-pm --rizin %s --per-rizin-site exec -- %s\n", s.rizinPath, s.rizinPath)
+}
+
 func (rp InstalledPackage) Name() string {
 	return rp.InstalledName
 }
-func (rp InstalledPackage) Version() string            { return "" }
+func (rp InstalledPackage) Version() string            { return rp.InstalledVersion }
 func (rp InstalledPackage) Description() string        { return "" }
 func (rp InstalledPackage) Summary() string            { return "" }
+func (rp InstalledPackage) Category() string           { return "" }
+func (rp InstalledPackage) Tags() []string             { return nil }
 func (rp InstalledPackage) Source() RizinPackageSource { return RizinPackageSource{} }
 func (rp InstalledPackage) Download(baseArtifactsPath string) error {
 	return fmt.Errorf("cannot be called")
@@ -211,12 +356,86 @@ func (s *RizinSite) RizinVersion() string {
 	return s.rizinVersion
 }
 
+// RizinBinary returns the path of the rizin binary the site is used with
+func (s *RizinSite) RizinBinary() string {
+	return s.rizinPath
+}
+
 func (s *RizinSite) IsPackageInstalled(pkg Package) bool {
 	name := pkg.Name()
 	_, err := s.GetInstalledPackage(name)
 	return err == nil
 }
 
+// SearchPackages returns the available packages matching query, best match
+// first. Matching is case-insensitive and tolerates small typos.
+func (s *RizinSite) SearchPackages(query string, filter SearchFilter) ([]SearchResult, error) {
+	packages, err := s.ListAvailablePackages()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []Package{}
+	for _, p := range packages {
+		installed := s.IsPackageInstalled(p)
+		switch filter {
+		case SearchInstalled:
+			if !installed {
+				continue
+			}
+		case SearchNotInstalled:
+			if installed {
+				continue
+			}
+		case SearchUpgradable:
+			if !s.isPackageUpgradable(p) {
+				continue
+			}
+		}
+		filtered = append(filtered, p)
+	}
+
+	return searchPackages(filtered, query), nil
+}
+
+// isPackageUpgradable reports whether pkg is a newer release of an installed
+// package, like `rz-pm outdated` does
+func (s *RizinSite) isPackageUpgradable(pkg Package) bool {
+	installedPackage, err := s.GetInstalledPackage(pkg.Name())
+	if err != nil {
+		return false
+	}
+	return isOutdated(installedPackage, pkg)
+}
+
+// DatabaseChanges returns the packages changed by the last update of the
+// database.
+func (s *RizinSite) DatabaseChanges() (DatabaseChanges, error) {
+	return s.Database.Changes()
+}
+
+// VerifyPackages checks the installed files of the named packages, or of all
+// the installed packages when names is empty.
+func (s *RizinSite) VerifyPackages(names []string) (VerifyReport, error) {
+	// disabled packages are checked where their plugins are kept
+	installed := []InstalledPackage{}
+	for _, p := range s.installedPackages {
+		installed = append(installed, s.withDisabledPaths(p))
+	}
+	packages := installed
+	if len(names) > 0 {
+		packages = []InstalledPackage{}
+		for _, name := range names {
+			p, err := s.GetInstalledPackage(name)
+			if err != nil {
+				return VerifyReport{}, err
+			}
+			packages = append(packages, s.withDisabledPaths(p))
+		}
+	}
+	return verifyPackages(s.GetPrefix(), packages, installed), nil
+}
+
 func (s *RizinSite) GetPackage(name string) (Package, error) {
 	return s.Database.GetPackage(name)
 }
@@ -241,36 +460,71 @@ func (s *RizinSite) GetCMakeDir() string {
 	return s.CMakePath
 }
 
-func (s *RizinSite) InstallPackage(pkg Package) error {
+// GetPrefix returns the install prefix of the site
+func (s *RizinSite) GetPrefix() string {
+	return s.Config.Prefix
+}
+
+func (s *RizinSite) InstallPackage(pkg Package, opts InstallOptions) (err error) {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	defer s.recordHistory(OperationInstall, pkg.Name(), pkg.Version(), &err)
 	if s.IsPackageInstalled(pkg) {
 		return fmt.Errorf("package %s already installed", pkg.Name())
 	}
 
-	files, err := pkg.Install(s)
+	files, err := pkg.Install(installContext{RizinSite: s, opts: opts})
 	if err != nil {
 		return err
 	}
+	// the files of other packages overwritten with --force, or that could
+	// not be detected before the installation
+	s.takeOverFiles(pkg.Name(), files)
 
-	minorVersion := GetMajorMinorVersion(s.rizinVersion)
-	s.installedPackages = append(s.installedPackages, InstalledPackage{
-		pkg.Name(),
-		&files,
-		&minorVersion,
-	})
+	ip := s.newInstalledPackage(pkg, files)
+	ip.Broken = s.checkInstalledPlugins(pkg.Name(), files)
+	s.installedPackages = append(s.installedPackages, ip)
 	installedFilePath := filepath.Join(s.Path, installedFile)
 	return updateInstalledPackages(installedFilePath, s.installedPackages)
 }
 
-func (s *RizinSite) UninstallPackage(pkg Package) error {
-	if !s.IsPackageInstalled(pkg) {
-		return fmt.Errorf("package %s not installed", pkg.Name())
+func (s *RizinSite) newInstalledPackage(pkg Package, files []string) InstalledPackage {
+	minorVersion := GetMajorMinorVersion(s.rizinVersion)
+	return InstalledPackage{
+		InstalledName:    pkg.Name(),
+		InstalledVersion: pkg.Version(),
+		InstalledFiles:   &files,
+		RizinVersion:     &minorVersion,
+		FileInfo:         recordInstalledFiles(files),
+		InstalledSource:  installedSource(s.GetArtifactsDir(), pkg),
 	}
+}
 
-	installedPackage, err := s.GetInstalledPackage(pkg.Name())
-	if err != nil {
+// replaceInstalledPackage replaces the installed package with the same name
+// as ip
+func (s *RizinSite) replaceInstalledPackage(ip InstalledPackage) {
+	for i := range s.installedPackages {
+		if s.installedPackages[i].Name() == ip.Name() {
+			s.installedPackages[i] = ip
+		}
+	}
+}
+
+func (s *RizinSite) UninstallPackage(pkg Package) (err error) {
+	if err := s.checkExclusive(); err != nil {
 		return err
 	}
+	installedPackage, installedErr := s.GetInstalledPackage(pkg.Name())
+	archive := ""
+	defer func() {
+		s.recordHistoryEntry(HistoryEntry{Operation: OperationUninstall, Package: pkg.Name(), Version: installedPackage.Version(), Archive: archive}, &err)
+	}()
+	if !s.IsPackageInstalled(pkg) || installedErr != nil {
+		return fmt.Errorf("package %s not installed", pkg.Name())
+	}
 
+	var kept []string
 	if installedPackage.InstalledFiles == nil {
 		// NOTE: kept for compatibility with v0.1.9
 		err = pkg.Uninstall(s)
@@ -278,26 +532,52 @@ func (s *RizinSite) UninstallPackage(pkg Package) error {
 			return err
 		}
 	} else {
-		fmt.Printf("Uninstalling %s...\n", pkg.Name())
-		for _, file := range *installedPackage.InstalledFiles {
-			os.RemoveAll(file)
+		// kept to undo the uninstall, or to roll back to it
+		if err := s.saveRollback(installedPackage); err != nil {
+			warnf("could not save %s %s for rollback: %v", pkg.Name(), installedPackage.Version(), err)
+		} else if saved, err := s.saveUninstalled(installedPackage); err != nil {
+			warnf("could not save %s %s to undo its uninstall: %v", pkg.Name(), installedPackage.Version(), err)
+		} else {
+			archive = saved
 		}
-
+		fmt.Printf("Uninstalling %s...\n", pkg.Name())
+		kept = s.removeInstalledFiles(installedPackage)
 	}
 
-	s.installedPackages = removePackageFromSlice(s.installedPackages, pkg.Name())
-	fmt.Printf("Package %s uninstalled.\n", pkg.Name())
+	if len(kept) > 0 {
+		// the package is still installed, with the files left
+		remaining := map[string]bool{}
+		for _, f := range kept {
+			remaining[f] = true
+		}
+		s.replaceInstalledPackage(installedPackage.keepFiles(func(f string) bool { return remaining[f] }))
+	} else {
+		s.installedPackages = removePackageFromSlice(s.installedPackages, pkg.Name())
+		s.dropDisabledPlugins(pkg.Name())
+		fmt.Printf("Package %s uninstalled.\n", pkg.Name())
+	}
 
 	installedFilePath := filepath.Join(s.Path, installedFile)
-	return updateInstalledPackages(installedFilePath, s.installedPackages)
+	err = updateInstalledPackages(installedFilePath, s.installedPackages)
+	if err != nil {
+		return err
+	}
+	if len(kept) > 0 {
+		return fmt.Errorf("package %s was only partially uninstalled, %d of its files were kept: remove them and uninstall it again", pkg.Name(), len(kept))
+	}
+	return nil
 }
 
-func (s *RizinSite) CleanPackage(pkg Package) error {
+func (s *RizinSite) CleanPackage(pkg Package) (err error) {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
 	pkgArtifactsPath := filepath.Join(s.GetArtifactsDir(), pkg.Name(), pkg.Version())
-	_, err := os.Stat(pkgArtifactsPath)
-	if err != nil {
-		return fmt.Errorf("package %s does not have any build artifacts", pkg.Name())
+	if _, err := os.Stat(pkgArtifactsPath); err != nil {
+		// nothing to clean, not recorded in the history
+		return fmt.Errorf("%w for package %s", ErrNoArtifacts, pkg.Name())
 	}
+	defer s.recordHistory(OperationClean, pkg.Name(), pkg.Version(), &err)
 
 	err = os.RemoveAll(pkgArtifactsPath)
 	if err != nil {
@@ -308,9 +588,21 @@ func (s *RizinSite) CleanPackage(pkg Package) error {
 }
 
 func (s *RizinSite) Remove() error {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
 	return os.RemoveAll(s.Path)
 }
 
+// checkExclusive fails when the site is opened with a shared lock, as other
+// instances might be reading it.
+func (s *RizinSite) checkExclusive() error {
+	if s.lock != nil && s.lock.mode != LockExclusive {
+		return ErrSiteShared
+	}
+	return nil
+}
+
 func (s *RizinSite) Close() error {
 	if s.lock == nil {
 		panic("site lock is nil, cannot close")
@@ -324,24 +616,31 @@ func (s *RizinSite) Close() error {
 	return nil
 }
 
-func getRizinVersion() (string, error) {
-	if _, err := exec.LookPath("rizin"); err != nil {
-		return "", fmt.Errorf("rizin does not seem to be installed on your system. Make sure it is installed and in PATH")
+const defaultRizin string = "rizin"
+
+// findRizin returns the absolute path of the rizin binary to use. rizin can
+// be a path or a name to look up in PATH, an empty string means "rizin".
+func findRizin(rizin string) (string, error) {
+	if rizin == "" {
+		rizin = defaultRizin
 	}
-	cmd := exec.Command("rizin", "-H", "RZ_VERSION")
-	out, err := cmd.Output()
+	path, err := exec.LookPath(rizin)
 	if err != nil {
-		return "", err
+		if rizin == defaultRizin {
+			return "", fmt.Errorf("rizin does not seem to be installed on your system. Make sure it is installed and in PATH")
+		}
+		return "", fmt.Errorf("could not find rizin binary %s: %w", rizin, err)
 	}
-
-	return strings.TrimRight(string(out), "\r\n"), nil
+	return filepath.Abs(path)
 }
 
-func getRizinLibPath() (string, error) {
-	if _, err := exec.LookPath("rizin"); err != nil {
-		return "", fmt.Errorf("rizin does not seem to be installed on your system. Make sure it is installed and in PATH")
+// getRizinVariable returns the value of a rizin -H variable, e.g. RZ_LIBDIR
+func getRizinVariable(rizin string, variable string) (string, error) {
+	path, err := findRizin(rizin)
+	if err != nil {
+		return "", err
 	}
-	cmd := exec.Command("rizin", "-H", "RZ_LIBDIR")
+	cmd := exec.Command(path, "-H", variable)
 	out, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -350,8 +649,16 @@ func getRizinLibPath() (string, error) {
 	return strings.TrimRight(string(out), "\r\n"), nil
 }
 
-func getPkgConfigPath() (string, error) {
-	libPath, err := getRizinLibPath()
+func getRizinVersion(rizin string) (string, error) {
+	return getRizinVariable(rizin, "RZ_VERSION")
+}
+
+func getRizinLibPath(rizin string) (string, error) {
+	return getRizinVariable(rizin, "RZ_LIBDIR")
+}
+
+func getPkgConfigPath(rizin string) (string, error) {
+	libPath, err := getRizinLibPath(rizin)
 	if err != nil {
 		return "", err
 	}
@@ -365,8 +672,8 @@ func getPkgConfigPath() (string, error) {
 	return pkgConfigPath, nil
 }
 
-func getCMakePath() (string, error) {
-	libPath, err := getRizinLibPath()
+func getCMakePath(rizin string) (string, error) {
+	libPath, err := getRizinLibPath(rizin)
 	if err != nil {
 		return "", err
 	}
@@ -380,56 +687,6 @@ func getCMakePath() (string, error) {
 	return cmakePath, nil
 }
 
-func getInstalledPackages(path string, rizinVersion string) ([]InstalledPackage, error) {
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return []InstalledPackage{}, nil
-	}
-
-	by, err := os.ReadFile(path)
-	if err != nil {
-		return []InstalledPackage{}, err
-	}
-
-	var v []InstalledPackage
-	err = json.Unmarshal(by, &v)
-	if err != nil {
-		var vs []string
-		err = json.Unmarshal(by, &vs)
-		if err != nil {
-			return []InstalledPackage{}, err
-		}
-
-		v = []InstalledPackage{}
-		for _, s := range vs {
-			if s != "" {
-				v = append(v, InstalledPackage{InstalledName: s, InstalledFiles: nil, RizinVersion: nil})
-			}
-		}
-	}
-
-	version := GetMajorMinorVersion(rizinVersion)
-	for i := range v {
-		if v[i].RizinVersion == nil {
-			v[i].RizinVersion = &version
-		}
-	}
-
-	return v, nil
-}
-
-func updateInstalledPackages(path string, packages []InstalledPackage) error {
-	by, err := json.Marshal(packages)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(path, by, fs.FileMode(0622))
-	if err != nil {
-		return err
-	}
-	return err
-}
-
 func removePackageFromSlice(sl []InstalledPackage, name string) []InstalledPackage {
 	for i := range sl {
 		if sl[i].InstalledName == name {
@@ -454,81 +711,3 @@ func (s *RizinSite) GetInstalledPackage(name string) (InstalledPackage, error) {
 	}
 	return InstalledPackage{}, fmt.Errorf("installed package %s not found", name)
 }
-
-func newSiteLock(path string) *SiteLock {
-	return &SiteLock{
-		mu:     sync.Mutex{},
-		locked: false,
-		path:   filepath.Join(path, "site.lock"),
-	}
-}
-
-func (sl *SiteLock) Lock() error {
-	// take complete ownership of the struct
-	sl.mu.Lock()
-	defer sl.mu.Unlock()
-
-	lockFile, err := os.OpenFile(sl.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
-	if err != nil {
-		if os.IsExist(err) {
-			return ErrSiteLocked
-		}
-		return fmt.Errorf("could not create lock file %s: %w", sl.path, err)
-	}
-
-	err = lockFile.Close()
-	if err != nil {
-		return fmt.Errorf("could not close lock file %s: %w", sl.path, err)
-	}
-
-	sl.locked = true
-	sl.startInterruptCleanup()
-	return nil
-}
-
-func (sl *SiteLock) Unlock() error {
-	sl.mu.Lock()
-	defer sl.mu.Unlock()
-
-	if !sl.locked {
-		return fmt.Errorf("site lock is not active")
-	}
-
-	if sl.interruptSignals != nil {
-		signal.Stop(sl.interruptSignals)
-		close(sl.interruptCleanup)
-		sl.interruptSignals = nil
-		sl.interruptCleanup = nil
-	}
-
-	err := os.Remove(sl.path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			sl.locked = false
-			return nil // lock file already removed
-		}
-		return fmt.Errorf("could not remove lock file %s: %w", sl.path, err)
-	}
-
-	sl.locked = false
-	return nil
-}
-
-func (sl *SiteLock) startInterruptCleanup() {
-	signals := make(chan os.Signal, 1)
-	cleanupDone := make(chan struct{})
-
-	sl.interruptSignals = signals
-	sl.interruptCleanup = cleanupDone
-	signal.Notify(signals, os.Interrupt)
-
-	go func() {
-		select {
-		case <-cleanupDone:
-			return
-		case <-signals:
-			_ = sl.Unlock()
-			os.Exit(130)
-		}
-	}()
-}
@@ -239,6 +239,12 @@ func (fp FakePackage) Summary() string {
 func (fp FakePackage) Description() string {
 	return ""
 }
+func (fp FakePackage) Category() string {
+	return ""
+}
+func (fp FakePackage) Tags() []string {
+	return nil
+}
 func (fp FakePackage) Source() RizinPackageSource {
 	return RizinPackageSource{}
 }
@@ -264,7 +270,7 @@ func TestListInstalledPackages(t *testing.T) {
 
 	pkg := FakePackage{myName: "jsdec"}
 
-	err = site.InstallPackage(pkg)
+	err = site.InstallPackage(pkg, InstallOptions{})
 	require.NoError(t, err)
 
 	packages, err := site.ListAvailablePackages()
@@ -276,3 +282,118 @@ func TestListInstalledPackages(t *testing.T) {
 	assert.Len(t, installedPackages, 1, "there should be just one package installed")
 	assert.Equal(t, "jsdec", installedPackages[0].Name(), "jsdec package should be installed")
 }
+
+// writeFakeRizin creates a script answering the rizin -H queries done by
+// rz-pm, so that sites can be opened without a real rizin installation.
+func writeFakeRizin(t *testing.T, dir string, version string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake rizin is a shell script")
+	}
+
+	libDir := filepath.Join(dir, "lib")
+	require.NoError(t, os.MkdirAll(libDir, 0755))
+	path := filepath.Join(dir, "rizin")
+	// -H prints variables, -c "L <path>" loads a plugin, failing to load
+	// the ones called broken
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = -H ]; then\n" +
+		"case \"$2\" in\n" +
+		"RZ_VERSION) echo " + version + " ;;\n" +
+		"RZ_LIBDIR) echo " + libDir + " ;;\n" +
+		"RZ_PREFIX) echo " + dir + " ;;\n" +
+		"esac\n" +
+		"exit 0\n" +
+		"fi\n" +
+		"for a in \"$@\"; do\n" +
+		"case \"$a\" in\n" +
+		"*broken*) echo \"Cannot load ${a#L }: undefined symbol\" >&2; exit 1 ;;\n" +
+		"esac\n" +
+		"done\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0755))
+	return path
+}
+
+// newTestSite opens a new site, with its own prefix and a fake rizin 0.8.1,
+// that is closed at the end of the test
+func newTestSite(t *testing.T) *RizinSite {
+	t.Helper()
+	rizin := writeFakeRizin(t, t.TempDir(), "0.8.1")
+	site, err := InitSiteWithOptions(t.TempDir(), SiteOptions{Rizin: rizin, Prefix: PrefixSite})
+	require.NoError(t, err)
+	rs := site.(*RizinSite)
+	t.Cleanup(func() {
+		if rs.lock.locked {
+			rs.Close()
+		}
+	})
+	return rs
+}
+
+func TestSiteRizinBinary(t *testing.T) {
+	sitePath := t.TempDir()
+	rizin1 := writeFakeRizin(t, t.TempDir(), "0.7.3")
+	rizin2 := writeFakeRizin(t, t.TempDir(), "0.8.1")
+
+	site, err := InitSiteWithOptions(sitePath, SiteOptions{Rizin: rizin1})
+	require.NoError(t, err)
+	assert.Equal(t, rizin1, site.RizinBinary())
+	assert.Equal(t, "0.7.3", site.RizinVersion())
+	site.Close()
+
+	_, err = InitSiteWithOptions(sitePath, SiteOptions{Rizin: rizin2})
+	assert.ErrorIs(t, err, ErrRizinMismatch, "a site is bound to the rizin it was created for")
+
+	site, err = InitSiteWithOptions(sitePath, SiteOptions{Rizin: rizin2, PerRizinSite: true})
+	require.NoError(t, err)
+	assert.Equal(t, PerRizinSiteDir(sitePath, rizin2), site.GetBaseDir())
+	assert.Equal(t, filepath.Join(site.GetBaseDir(), sitePrefixDir), site.GetPrefix(), "per-rizin sites use their own prefix")
+	assert.Equal(t, "0.8.1", site.RizinVersion())
+	site.Close()
+
+	site, err = InitSiteWithOptions(sitePath, SiteOptions{Rizin: rizin1, PerRizinSite: true})
+	require.NoError(t, err)
+	assert.Equal(t, sitePath, site.GetBaseDir(), "the matching rizin keeps using the site")
+	site.Close()
+}
+
+func TestOlderSiteIsNotBoundToRizin(t *testing.T) {
+	sitePath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(sitePath, installedFile), []byte("[]"), 0644))
+	rizin1 := writeFakeRizin(t, t.TempDir(), "0.7.3")
+	rizin2 := writeFakeRizin(t, t.TempDir(), "0.8.1")
+
+	site, err := InitSiteWithOptions(sitePath, SiteOptions{Rizin: rizin1})
+	require.NoError(t, err)
+	site.Close()
+	config, err := readSiteConfig(sitePath)
+	require.NoError(t, err)
+	assert.Empty(t, config.Rizin, "sites created by older versions are not bound to the first rizin used")
+
+	site, err = InitSiteWithOptions(sitePath, SiteOptions{Rizin: rizin2})
+	require.NoError(t, err)
+	assert.Equal(t, rizin2, site.RizinBinary())
+	site.Close()
+}
+
+func TestSharedSite(t *testing.T) {
+	sitePath := t.TempDir()
+	rizin := writeFakeRizin(t, t.TempDir(), "0.8.1")
+	opts := SiteOptions{Rizin: rizin, LockMode: LockShared}
+
+	site1, err := InitSiteWithOptions(sitePath, opts)
+	require.NoError(t, err)
+	site2, err := InitSiteWithOptions(sitePath, opts)
+	require.NoError(t, err, "read-only sites should be opened concurrently")
+
+	err = site1.InstallPackage(FakePackage{}, InstallOptions{})
+	assert.ErrorIs(t, err, ErrSiteShared, "read-only sites cannot be modified")
+
+	_, err = InitSiteWithOptions(sitePath, SiteOptions{Rizin: rizin})
+	assert.ErrorIs(t, err, ErrSiteLocked)
+
+	site1.Close()
+	site2.Close()
+	site, err := InitSiteWithOptions(sitePath, SiteOptions{Rizin: rizin})
+	require.NoError(t, err)
+	site.Close()
+}
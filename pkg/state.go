@@ -0,0 +1,247 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// installedStateVersion is the schema version of the installed state file.
+// Bump it and add a stateMigration whenever the format changes.
+const installedStateVersion = 2
+
+const stateBackupSuffix = ".bak"
+
+type installedState struct {
+	Version  int                `json:"version"`
+	Packages []InstalledPackage `json:"packages"`
+}
+
+// stateMigration converts the raw installed state from version From to
+// version From+1.
+type stateMigration struct {
+	From        int
+	Description string
+	Migrate     func(raw []byte) ([]byte, error)
+}
+
+var stateMigrations = []stateMigration{
+	{
+		From:        0,
+		Description: "convert the list of package names used up to v0.1.9",
+		Migrate: func(raw []byte) ([]byte, error) {
+			var names []string
+			err := json.Unmarshal(raw, &names)
+			if err != nil {
+				return nil, err
+			}
+
+			packages := []InstalledPackage{}
+			for _, name := range names {
+				if name != "" {
+					packages = append(packages, InstalledPackage{InstalledName: name})
+				}
+			}
+			return json.Marshal(packages)
+		},
+	},
+	{
+		From:        1,
+		Description: "add the schema version",
+		Migrate: func(raw []byte) ([]byte, error) {
+			var packages []InstalledPackage
+			err := json.Unmarshal(raw, &packages)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(installedState{Version: 2, Packages: packages})
+		},
+	},
+}
+
+// installedStateVersionOf detects the schema version of a raw state. Before
+// version 2 the state was a bare list, either of package names (version 0)
+// or of package objects (version 1).
+func installedStateVersionOf(raw []byte) (int, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		var names []string
+		if json.Unmarshal(raw, &names) == nil {
+			return 0, nil
+		}
+		return 1, nil
+	}
+
+	var header struct {
+		Version *int `json:"version"`
+	}
+	err := json.Unmarshal(raw, &header)
+	if err != nil {
+		return 0, err
+	}
+	if header.Version == nil {
+		return 0, fmt.Errorf("missing schema version")
+	}
+	return *header.Version, nil
+}
+
+// migrateInstalledState upgrades a raw state to installedStateVersion and
+// reports whether any migration was applied.
+func migrateInstalledState(raw []byte) ([]byte, bool, error) {
+	v, err := installedStateVersionOf(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	if v > installedStateVersion {
+		return nil, false, fmt.Errorf("schema version %d is not supported, upgrade rz-pm", v)
+	}
+
+	migrated := false
+	for _, m := range stateMigrations {
+		if m.From != v {
+			continue
+		}
+		log.Printf("Migrating installed state from version %d: %s\n", m.From, m.Description)
+		raw, err = m.Migrate(raw)
+		if err != nil {
+			return nil, false, fmt.Errorf("migration from version %d failed: %w", m.From, err)
+		}
+		v++
+		migrated = true
+	}
+	if v != installedStateVersion {
+		return nil, false, fmt.Errorf("no migration from schema version %d", v)
+	}
+	return raw, migrated, nil
+}
+
+// invalidStateError describes why the installed state at path could not be
+// read, pointing to the previous state when a backup of it exists
+func invalidStateError(path string, err error) error {
+	backup := path + stateBackupSuffix
+	if _, statErr := os.Stat(backup); statErr == nil {
+		return fmt.Errorf("could not read installed state %s (the previous state is kept in %s): %w", path, backup, err)
+	}
+	return fmt.Errorf("could not read installed state %s: %w", path, err)
+}
+
+// getInstalledPackages reads the installed state at path, migrating it to the
+// current schema. The migrated state is written back only when save is true.
+func getInstalledPackages(path string, rizinVersion string, save bool) ([]InstalledPackage, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []InstalledPackage{}, nil
+	} else if err != nil {
+		return []InstalledPackage{}, err
+	}
+
+	raw, migrated, err := migrateInstalledState(raw)
+	if err != nil {
+		return []InstalledPackage{}, invalidStateError(path, err)
+	}
+
+	var state installedState
+	err = json.Unmarshal(raw, &state)
+	if err != nil {
+		return []InstalledPackage{}, invalidStateError(path, err)
+	}
+	if state.Packages == nil {
+		state.Packages = []InstalledPackage{}
+	}
+
+	version := GetMajorMinorVersion(rizinVersion)
+	for i := range state.Packages {
+		if state.Packages[i].RizinVersion == nil {
+			state.Packages[i].RizinVersion = &version
+		}
+	}
+
+	if migrated && save {
+		err = updateInstalledPackages(path, state.Packages)
+		if err != nil {
+			return []InstalledPackage{}, fmt.Errorf("could not save migrated installed state: %w", err)
+		}
+	}
+	return state.Packages, nil
+}
+
+func updateInstalledPackages(path string, packages []InstalledPackage) error {
+	by, err := json.MarshalIndent(installedState{Version: installedStateVersion, Packages: packages}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, by, 0644, true)
+}
+
+func copyFile(src string, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new content, never a partial file. When backup is set, the
+// previous content is kept next to path with the stateBackupSuffix.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, backup bool) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
+	}
+
+	if backup {
+		err = copyFile(path, path+stateBackupSuffix, perm)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not back up %s: %w", path, err)
+		}
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// persist the rename, not supported on every platform
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
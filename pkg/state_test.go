@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstalledStateMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"v0", `["jsdec", ""]`},
+		{"v1", `[{"name": "jsdec", "files": ["/tmp/libjsdec.so"], "rizin_version": "0.8"}]`},
+		{"v2", `{"version": 2, "packages": [{"name": "jsdec", "files": null, "rizin_version": null}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "installed")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0644))
+
+			packages, err := getInstalledPackages(path, "0.8.1", true)
+			require.NoError(t, err)
+			require.Len(t, packages, 1)
+			assert.Equal(t, "jsdec", packages[0].InstalledName)
+			require.NotNil(t, packages[0].RizinVersion)
+			assert.Equal(t, "0.8", *packages[0].RizinVersion)
+
+			raw, err := os.ReadFile(path)
+			require.NoError(t, err)
+			v, err := installedStateVersionOf(raw)
+			require.NoError(t, err)
+			assert.Equal(t, installedStateVersion, v, "the migrated state should be saved")
+		})
+	}
+}
+
+func TestInstalledStateFromNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "installed")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 999, "packages": []}`), 0644))
+
+	_, err := getInstalledPackages(path, "0.8.1", true)
+	assert.ErrorContains(t, err, "upgrade rz-pm")
+}
+
+func TestInvalidInstalledState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "installed")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 2, "packages": {}}`), 0644))
+
+	_, err := getInstalledPackages(path, "0.8.1", true)
+	assert.ErrorContains(t, err, "could not read installed state")
+	assert.NotContains(t, err.Error(), "previous state", "there is no backup to point to")
+
+	require.NoError(t, os.WriteFile(path+stateBackupSuffix, []byte(`{"version": 2, "packages": []}`), 0644))
+	_, err = getInstalledPackages(path, "0.8.1", true)
+	assert.ErrorContains(t, err, "the previous state is kept in "+path+stateBackupSuffix)
+}
+
+func TestUpdateInstalledPackagesKeepsBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "installed")
+	version := "0.8"
+
+	require.NoError(t, updateInstalledPackages(path, []InstalledPackage{{InstalledName: "first", RizinVersion: &version}}))
+	_, err := os.Stat(path + stateBackupSuffix)
+	assert.True(t, os.IsNotExist(err), "there is no previous state to back up")
+
+	require.NoError(t, updateInstalledPackages(path, []InstalledPackage{{InstalledName: "second", RizinVersion: &version}}))
+	backup, err := getInstalledPackages(path+stateBackupSuffix, "0.8.1", true)
+	require.NoError(t, err)
+	require.Len(t, backup, 1)
+	assert.Equal(t, "first", backup[0].InstalledName)
+
+	current, err := getInstalledPackages(path, "0.8.1", true)
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.Equal(t, "second", current[0].InstalledName)
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "no temporary file should be left behind")
+}
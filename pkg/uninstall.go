@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// removeInstalledFiles removes the files installed by ip, keeping the ones
+// that are not safe to remove, and prunes the directories left empty up to
+// prefix. It returns the files of ip that are still in place, because they
+// were kept or could not be removed.
+func (s *RizinSite) removeInstalledFiles(ip InstalledPackage) []string {
+	prefix := s.GetPrefix()
+	fileInfo := map[string]InstalledFile{}
+	for _, f := range ip.FileInfo {
+		fileInfo[f.Path] = f
+	}
+	shared := s.fileConflicts(ip.Name(), ip.files())
+
+	kept := []string{}
+	dirs := map[string]bool{}
+	for _, file := range ip.files() {
+		fi, err := os.Lstat(file)
+		if os.IsNotExist(err) {
+			if isWithinDir(prefix, file) {
+				dirs[filepath.Dir(file)] = true
+			}
+			continue
+		}
+		// files outside of the prefix are left in place, but not recorded
+		// anymore, so that the package can still be uninstalled
+		if !isWithinDir(prefix, file) {
+			warnf("not removing %s, it is outside of the install prefix %s", file, prefix)
+			continue
+		}
+		if owner, ok := shared[file]; ok {
+			warnf("not removing %s, it is also owned by %s", file, owner)
+			continue
+		}
+		if err != nil {
+			warnf("could not remove %s: %v", file, err)
+			kept = append(kept, file)
+			continue
+		}
+		if !fi.Mode().IsRegular() && fi.Mode()&os.ModeSymlink == 0 {
+			warnf("not removing %s, it is not a regular file or a symbolic link", file)
+			continue
+		}
+		if recorded, ok := fileInfo[file]; ok {
+			if problem := checkInstalledFile(recorded); problem != nil {
+				warnf("not removing %s, it was modified after the installation (%s)", file, problem.Detail)
+				kept = append(kept, file)
+				continue
+			}
+		}
+
+		err = os.Remove(file)
+		if err != nil {
+			warnf("could not remove %s: %v", file, err)
+			kept = append(kept, file)
+			continue
+		}
+		dirs[filepath.Dir(file)] = true
+	}
+
+	// deepest directories first, so that their parents can be pruned too
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sortedDirs)))
+	for _, dir := range sortedDirs {
+		pruneEmptyDirs(prefix, dir)
+	}
+	return kept
+}
+
+// keepFiles returns ip recording only the files it installed for which keep
+// returns true
+func (ip InstalledPackage) keepFiles(keep func(path string) bool) InstalledPackage {
+	files := []string{}
+	for _, f := range ip.files() {
+		if keep(f) {
+			files = append(files, f)
+		}
+	}
+	var fileInfo []InstalledFile
+	for _, f := range ip.FileInfo {
+		if keep(f.Path) {
+			fileInfo = append(fileInfo, f)
+		}
+	}
+	ip.InstalledFiles = &files
+	ip.FileInfo = fileInfo
+	return ip
+}
+
+// pruneEmptyDirs removes dir and its parents, up to prefix excluded, as long
+// as they are empty.
+func pruneEmptyDirs(prefix string, dir string) {
+	prefix = filepath.Clean(prefix)
+	for dir = filepath.Clean(dir); dir != prefix && isWithinDir(prefix, dir); dir = filepath.Dir(dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) != 0 {
+			return
+		}
+		if err := os.Remove(dir); err != nil {
+			warnf("could not remove empty directory %s: %v", dir, err)
+			return
+		}
+	}
+}
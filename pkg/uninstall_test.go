@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeUninstall(t *testing.T) {
+	site := newTestSite(t)
+
+	prefix := site.GetPrefix()
+	pluginsDir := filepath.Join(prefix, "lib", "rizin", "plugins")
+	plugin := filepath.Join(pluginsDir, "plugin.so")
+	modified := filepath.Join(pluginsDir, "modified.so")
+	data := filepath.Join(prefix, "share", "plugin", "data", "types.sdb")
+	pkg := filesPackage{FakePackage{myName: "plugin"}, []string{plugin, modified, data}}
+	require.NoError(t, site.InstallPackage(pkg, InstallOptions{}))
+
+	require.NoError(t, os.WriteFile(modified, []byte("changed by the user"), 0644))
+	err := site.UninstallPackage(pkg)
+	assert.ErrorContains(t, err, "only partially uninstalled")
+	installed, err := site.GetInstalledPackage("plugin")
+	require.NoError(t, err, "packages with files left should stay installed")
+	assert.Equal(t, []string{modified}, installed.files())
+	require.Len(t, installed.FileInfo, 1)
+
+	_, err = os.Stat(plugin)
+	assert.True(t, os.IsNotExist(err), "unmodified files should be removed")
+	_, err = os.Stat(modified)
+	assert.NoError(t, err, "modified files should be kept")
+	_, err = os.Stat(filepath.Join(prefix, "share"))
+	assert.True(t, os.IsNotExist(err), "empty directories should be pruned")
+	_, err = os.Stat(prefix)
+	assert.NoError(t, err, "the prefix itself should never be removed")
+
+	require.NoError(t, os.Remove(modified))
+	require.NoError(t, site.UninstallPackage(pkg))
+	assert.False(t, site.IsPackageInstalled(pkg))
+}
+
+func TestUninstallKeepsDirectories(t *testing.T) {
+	site := newTestSite(t)
+
+	// an installed state recording a directory, e.g. written by hand
+	dir := filepath.Join(site.GetPrefix(), "lib")
+	unrelated := filepath.Join(dir, "unrelated.so")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(unrelated, []byte{}, 0644))
+	files := []string{dir}
+	kept := site.removeInstalledFiles(InstalledPackage{InstalledName: "broken", InstalledFiles: &files})
+	assert.Empty(t, kept)
+
+	_, err := os.Stat(unrelated)
+	assert.NoError(t, err, "recorded directories should never be removed")
+}
+
+func TestUninstallOutsideOfPrefix(t *testing.T) {
+	site := newTestSite(t)
+
+	plugin := filepath.Join(site.GetPrefix(), "lib", "rizin", "plugins", "plugin.so")
+	pkg := filesPackage{FakePackage{myName: "plugin"}, []string{plugin}}
+	require.NoError(t, site.InstallPackage(pkg, InstallOptions{}))
+
+	// an installed state recording files outside of the prefix, e.g.
+	// written by an older rz-pm with a different prefix
+	outside := t.TempDir()
+	missing := filepath.Join(outside, "missing.so")
+	existing := filepath.Join(outside, "existing.so")
+	require.NoError(t, os.WriteFile(existing, []byte{}, 0644))
+	installed, err := site.GetInstalledPackage("plugin")
+	require.NoError(t, err)
+	files := append(installed.files(), missing, existing)
+	installed.InstalledFiles = &files
+	site.replaceInstalledPackage(installed)
+
+	require.NoError(t, site.UninstallPackage(pkg))
+	assert.False(t, site.IsPackageInstalled(pkg))
+	_, err = os.Stat(existing)
+	assert.NoError(t, err, "files outside of the prefix should not be removed")
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// SourceRevision identifies the source code a package was built from
+type SourceRevision struct {
+	URL string `json:"url"`
+	// Hash is the SHA256 of the source archive, if any
+	Hash string `json:"hash,omitempty"`
+	// Commit is the git commit that was built, for git sources
+	Commit string `json:"commit,omitempty"`
+}
+
+// OutdatedPackage is an installed package with a newer release in the
+// database
+type OutdatedPackage struct {
+	Installed InstalledPackage
+	Available Package
+}
+
+// gitCommit returns the commit checked out in the git repository at path
+func gitCommit(path string) (string, error) {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
+// installedSource returns the identity of the source code pkg was just built
+// from, or nil when pkg does not come from a known source.
+func installedSource(artifactsDir string, pkg Package) *SourceRevision {
+	source := pkg.Source()
+	if source.URL == "" {
+		return nil
+	}
+
+	s := &SourceRevision{URL: redactURL(source.URL), Hash: source.Hash}
+	rp := RizinPackage{PackageName: pkg.Name(), PackageVersion: pkg.Version(), PackageSource: &source}
+	if rp.isGitRepo() {
+		repoPath := filepath.Join(rp.artifactsPath(artifactsDir), gitProjectNameFromURL(source.URL))
+		commit, err := gitCommit(repoPath)
+		if err != nil {
+			warnf("could not find the git commit of %s: %v", pkg.Name(), err)
+		}
+		s.Commit = commit
+	}
+	return s
+}
+
+// isOutdated reports whether available is a newer release of the installed
+// package, either with a higher version or with a different source archive
+// for the same version. Packages installed by older versions of rz-pm, whose
+// version is unknown, are always outdated, as upgrading records it.
+func isOutdated(installed InstalledPackage, available Package) bool {
+	if installed.InstalledVersion == "" {
+		return true
+	}
+	if isNewerVersion(available.Version(), installed.InstalledVersion) {
+		return true
+	}
+	if available.Version() != installed.InstalledVersion || installed.InstalledSource == nil {
+		return false
+	}
+	hash := available.Source().Hash
+	return hash != "" && installed.InstalledSource.Hash != "" && hash != installed.InstalledSource.Hash
+}
+
+// ListOutdatedPackages returns the installed packages that have a newer
+// release in the database. Packages not in the database are ignored.
+func (s *RizinSite) ListOutdatedPackages() ([]OutdatedPackage, error) {
+	outdated := []OutdatedPackage{}
+	for _, installed := range s.installedPackages {
+		available, err := s.GetPackage(installed.Name())
+		if err != nil {
+			continue
+		}
+		if isOutdated(installed, available) {
+			outdated = append(outdated, OutdatedPackage{Installed: installed, Available: available})
+		}
+	}
+	return outdated, nil
+}
+
+// UpgradePackage replaces the installed version of pkg with pkg. The new
+// version is installed over the old one, whose files are saved beforehand
+// and restored if the installation fails; the files it no longer installs
+// are removed once it succeeds.
+func (s *RizinSite) UpgradePackage(pkg Package, opts InstallOptions) (err error) {
+	if err := s.checkExclusive(); err != nil {
+		return err
+	}
+	defer s.recordHistory(OperationUpgrade, pkg.Name(), pkg.Version(), &err)
+	old, err := s.GetInstalledPackage(pkg.Name())
+	if err != nil {
+		return fmt.Errorf("package %s not installed", pkg.Name())
+	}
+
+	// NOTE: the files of packages installed by v0.1.9 are unknown, they are
+	// overwritten by the new version
+	if old.InstalledFiles != nil {
+		if err := s.saveRollback(old); err != nil {
+			return fmt.Errorf("could not save %s %s to restore it if the upgrade fails: %w", old.Name(), old.Version(), err)
+		}
+	}
+
+	files, err := pkg.Install(installContext{RizinSite: s, opts: opts})
+	if err != nil {
+		if old.InstalledFiles == nil {
+			return err
+		}
+		if restoreErr := s.restoreRollback(old); restoreErr != nil {
+			return fmt.Errorf("could not install %s %s: %w, and %s could not be restored: %v", pkg.Name(), pkg.Version(), err, old.Version(), restoreErr)
+		}
+		return fmt.Errorf("could not install %s %s, %s is still installed: %w", pkg.Name(), pkg.Version(), old.Version(), err)
+	}
+	s.takeOverFiles(pkg.Name(), files)
+	if old.InstalledFiles != nil {
+		fmt.Printf("Removing the files of %s %s...\n", old.Name(), old.Version())
+		s.removeStaleFiles(old, files)
+	}
+
+	ip := s.newInstalledPackage(pkg, files)
+	ip.Broken = s.checkInstalledPlugins(pkg.Name(), files)
+	s.replaceInstalledPackage(ip)
+	s.dropDisabledPlugins(pkg.Name())
+	installedFilePath := filepath.Join(s.Path, installedFile)
+	return updateInstalledPackages(installedFilePath, s.installedPackages)
+}
@@ -1,6 +1,15 @@
 package pkg
 
-import "strings"
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// warnf prints a warning to stderr, apart from the output of the command
+func warnf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", args...)
+}
 
 func GetMajorMinorVersion(version string) string {
 	splits := strings.SplitN(version, ".", 3)
@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	FileMissing  = "missing"
+	FileModified = "modified"
+)
+
+// InstalledFile is the state of a file right after it was installed, used to
+// detect later changes.
+type InstalledFile struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256,omitempty"`
+	// Link is the target of symbolic links, which have no SHA256
+	Link string `json:"link,omitempty"`
+}
+
+// FileProblem is a difference between an installed file and its recorded
+// state. Kind is either FileMissing or FileModified.
+type FileProblem struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type VerifyResult struct {
+	Package  string        `json:"package"`
+	Problems []FileProblem `json:"problems"`
+	// NoChecksums is set for packages installed by older versions of rz-pm,
+	// of which only missing files can be detected
+	NoChecksums bool `json:"no_checksums,omitempty"`
+}
+
+// VerifyReport holds the results of the verified packages, and the files
+// found next to their files that no installed package owns, which are only
+// reported as a warning since other software might have installed them.
+type VerifyReport struct {
+	Packages []VerifyResult `json:"packages"`
+	Unowned  []string       `json:"unowned"`
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newInstalledFile(path string) (InstalledFile, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return InstalledFile{}, err
+	}
+
+	f := InstalledFile{Path: path, Size: fi.Size(), Mode: fi.Mode()}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		f.Size = 0
+		f.Link, err = os.Readlink(path)
+	case fi.Mode().IsRegular():
+		f.SHA256, err = fileSHA256(path)
+	}
+	if err != nil {
+		return InstalledFile{}, err
+	}
+	return f, nil
+}
+
+// recordInstalledFiles returns the state of the files just installed by a
+// package. Files that cannot be read are skipped with a warning.
+func recordInstalledFiles(paths []string) []InstalledFile {
+	files := []InstalledFile{}
+	for _, p := range paths {
+		f, err := newInstalledFile(p)
+		if err != nil {
+			warnf("could not record installed file %s: %v", p, err)
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// checkInstalledFile compares the file at f.Path with its recorded state
+func checkInstalledFile(f InstalledFile) *FileProblem {
+	current, err := newInstalledFile(f.Path)
+	if os.IsNotExist(err) {
+		return &FileProblem{Path: f.Path, Kind: FileMissing}
+	} else if err != nil {
+		return &FileProblem{Path: f.Path, Kind: FileModified, Detail: err.Error()}
+	}
+
+	var detail string
+	switch {
+	case current.Mode.Type() != f.Mode.Type():
+		detail = "file type changed"
+	case current.Link != f.Link:
+		detail = fmt.Sprintf("link target changed to %s", current.Link)
+	case current.Size != f.Size:
+		detail = fmt.Sprintf("size changed from %d to %d", f.Size, current.Size)
+	case current.SHA256 != f.SHA256:
+		detail = "content changed"
+	case current.Mode != f.Mode:
+		detail = fmt.Sprintf("mode changed from %s to %s", f.Mode, current.Mode)
+	default:
+		return nil
+	}
+	return &FileProblem{Path: f.Path, Kind: FileModified, Detail: detail}
+}
+
+// unownedFiles returns the files, in the directories holding the given
+// package files, that no installed package owns. The top-level directories of the
+// prefix (e.g. bin or lib) are shared with other software and not checked.
+func unownedFiles(prefix string, packageFiles []string, owned map[string]bool) []string {
+	dirs := map[string]bool{}
+	for _, p := range packageFiles {
+		dir := filepath.Dir(p)
+		rel, err := filepath.Rel(prefix, dir)
+		if err != nil || !isWithinDir(prefix, dir) || !strings.ContainsRune(filepath.ToSlash(rel), '/') {
+			continue
+		}
+		dirs[dir] = true
+	}
+
+	unowned := []string{}
+	for dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			if !e.IsDir() && !owned[p] {
+				unowned = append(unowned, p)
+			}
+		}
+	}
+	sort.Strings(unowned)
+	return unowned
+}
+
+// verifyPackages checks the files of the given installed packages against
+// their recorded state. installed are all the installed packages, used to
+// tell which files are owned by rz-pm.
+func verifyPackages(prefix string, packages []InstalledPackage, installed []InstalledPackage) VerifyReport {
+	owned := map[string]bool{}
+	for _, p := range installed {
+		for _, f := range p.files() {
+			owned[f] = true
+		}
+	}
+
+	report := VerifyReport{Packages: []VerifyResult{}}
+	packageFiles := []string{}
+	for _, p := range packages {
+		r := VerifyResult{Package: p.Name(), Problems: []FileProblem{}}
+		if len(p.FileInfo) == 0 {
+			r.NoChecksums = true
+			for _, f := range p.files() {
+				if _, err := os.Lstat(f); os.IsNotExist(err) {
+					r.Problems = append(r.Problems, FileProblem{Path: f, Kind: FileMissing})
+				}
+			}
+		} else {
+			for _, f := range p.FileInfo {
+				if problem := checkInstalledFile(f); problem != nil {
+					r.Problems = append(r.Problems, *problem)
+				}
+			}
+		}
+		packageFiles = append(packageFiles, p.files()...)
+		report.Packages = append(report.Packages, r)
+	}
+	report.Unowned = unownedFiles(prefix, packageFiles, owned)
+	return report
+}
+
+// files returns the paths of the files installed by the package
+func (ip InstalledPackage) files() []string {
+	if ip.InstalledFiles == nil {
+		return []string{}
+	}
+	return *ip.InstalledFiles
+}
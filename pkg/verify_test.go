@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPackages(t *testing.T) {
+	prefix := t.TempDir()
+	pluginsDir := filepath.Join(prefix, "lib", "rizin", "plugins")
+	require.NoError(t, os.MkdirAll(pluginsDir, 0755))
+	binDir := filepath.Join(prefix, "bin")
+	require.NoError(t, os.MkdirAll(binDir, 0755))
+
+	plugin := filepath.Join(pluginsDir, "core_plugin.so")
+	data := filepath.Join(pluginsDir, "plugin.sdb")
+	tool := filepath.Join(binDir, "plugin-tool")
+	for _, p := range []string{plugin, data, tool} {
+		require.NoError(t, os.WriteFile(p, []byte("original content"), 0644))
+	}
+	files := []string{plugin, data, tool}
+	installed := []InstalledPackage{{
+		InstalledName:  "plugin",
+		InstalledFiles: &files,
+		FileInfo:       recordInstalledFiles(files),
+	}}
+	require.Len(t, installed[0].FileInfo, 3)
+	assert.NotEmpty(t, installed[0].FileInfo[0].SHA256)
+
+	report := verifyPackages(prefix, installed, installed)
+	require.Len(t, report.Packages, 1)
+	assert.Empty(t, report.Packages[0].Problems, "nothing changed yet")
+	assert.Empty(t, report.Unowned)
+
+	require.NoError(t, os.WriteFile(plugin, []byte("tampered"), 0644))
+	require.NoError(t, os.Remove(data))
+	extra := filepath.Join(pluginsDir, "other_plugin.so")
+	require.NoError(t, os.WriteFile(extra, []byte{}, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "unrelated"), []byte{}, 0755))
+
+	report = verifyPackages(prefix, installed, installed)
+	require.Len(t, report.Packages, 1)
+	assert.ElementsMatch(t, []FileProblem{
+		{Path: plugin, Kind: FileModified, Detail: "size changed from 16 to 8"},
+		{Path: data, Kind: FileMissing},
+	}, report.Packages[0].Problems, "unowned files are not a problem of the package")
+	assert.Equal(t, []string{extra}, report.Unowned, "files in top-level directories like bin are not reported")
+
+	// a second package in the same directory
+	otherFiles := []string{filepath.Join(pluginsDir, "second.so")}
+	require.NoError(t, os.WriteFile(otherFiles[0], []byte{}, 0644))
+	installed = append(installed, InstalledPackage{InstalledName: "second", InstalledFiles: &otherFiles, FileInfo: recordInstalledFiles(otherFiles)})
+	report = verifyPackages(prefix, installed, installed)
+	assert.Equal(t, []string{extra}, report.Unowned, "unowned files are reported once")
+
+	if runtime.GOOS != "windows" {
+		require.NoError(t, os.Chmod(tool, 0755))
+		problem := checkInstalledFile(installed[0].FileInfo[2])
+		require.NotNil(t, problem)
+		assert.Equal(t, FileModified, problem.Kind)
+		assert.Contains(t, problem.Detail, "mode changed")
+	}
+}
+
+func TestVerifyPackagesWithoutChecksums(t *testing.T) {
+	prefix := t.TempDir()
+	files := []string{filepath.Join(prefix, "lib", "rizin", "plugins", "gone.so")}
+	installed := []InstalledPackage{{InstalledName: "old", InstalledFiles: &files}}
+
+	report := verifyPackages(prefix, installed, installed)
+	require.Len(t, report.Packages, 1)
+	assert.True(t, report.Packages[0].NoChecksums)
+	assert.Equal(t, []FileProblem{{Path: files[0], Kind: FileMissing}}, report.Packages[0].Problems)
+}